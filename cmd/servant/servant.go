@@ -39,8 +39,10 @@ func main() {
 
 	server.SetArgVars(vars)
 	server.SetEnvVars()
+	// vars set by config later are not used to load config, also when reloading
+	params := server.CloneGlobalParams()
 
-	config, err := conf.LoadXmlConfig(configs, configDirs, server.CloneGlobalParams())
+	config, err := conf.LoadXmlConfig(configs, configDirs, params)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(2)
@@ -52,7 +54,12 @@ func main() {
 			spew.Config.MaxDepth = 100
 			spew.Fdump(os.Stderr, config)
 		}*/
-	err = server.NewServer(&config).Run()
+	srv := server.NewServer(&config)
+	srv.SetConfigLoader(func() (*conf.Config, error) {
+		config, err := conf.LoadXmlConfig(configs, configDirs, params)
+		return &config, err
+	})
+	err = srv.Run()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(3)
@@ -1,9 +1,5 @@
 module github.com/xiezhenye/servant
 
-go 1.13
+go 1.20
 
-require (
-	github.com/go-sql-driver/mysql v1.5.0
-	github.com/pkg/errors v0.9.1
-	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0
-)
+require gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0
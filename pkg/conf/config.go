@@ -11,6 +11,7 @@ type Config struct {
 	Daemons   map[string]*Daemon
 
 	Auth Auth
+	Jobs Jobs
 	Log  string
 
 	Debug bool
@@ -18,17 +19,56 @@ type Config struct {
 
 type Server struct {
 	Listen string
+	// seconds to wait for running requests when shutting down
+	ShutdownTimeout uint32
+	ReadTimeout     uint32
+	WriteTimeout    uint32
+	IdleTimeout     uint32
+	MaxHeaderBytes  int
+	TLS             TLS
+}
+
+// TLS is enabled when Cert is set. Client certificates are verified by ClientCA if set.
+type TLS struct {
+	Cert     string
+	Key      string
+	ClientCA string
+	// "require" or "optional", default is optional
+	ClientAuth string
 }
 
 type Auth struct {
-	Enabled      bool
-	MaxTimeDelta uint32
+	Enabled        bool
+	MaxTimeDelta   uint32
+	Legacy         bool
+	MaxNonces      int
+	TrustedProxies []string
+}
+
+type Jobs struct {
+	Max       int
+	Retention uint32
+	Output    int
 }
 
 type User struct {
-	Hosts  []string
-	Key    string
-	Allows map[string][]string
+	Hosts []string
+	Key   string
+	// subjects or SANs of client certificates
+	Certs    []string
+	Admin    bool
+	Allows   map[string][]string
+	Controls map[string][]string
+	// rules limiting items and methods in allowed groups, by resource.
+	// a group without rules allows all of its items and methods
+	Permissions map[string][]Permission
+}
+
+// Permission allows items and methods of a group, empty Items or Methods allow all
+type Permission struct {
+	Group   string
+	Items   []string
+	Methods []string
 }
 
 type Commands struct {
@@ -41,10 +81,31 @@ type Command struct {
 	Timeout    uint32
 	User       string
 	Background bool
+	Stream     bool
+	Stderr     string
+	Output     string
+	Env        []Env
+	Workdir    string
+	CleanEnv   bool
+	Limits     Limits
 	Validators Validators
 	Lock       Lock
 }
 
+type Limits struct {
+	Memory string
+	Cpu    int
+	Nofile uint64
+	Nproc  uint64
+	Nice   int
+	Ionice string
+}
+
+type Env struct {
+	Name  string
+	Value string
+}
+
 type Database struct {
 	Queries map[string]*Query
 	Driver  string
@@ -56,10 +117,42 @@ type Query struct {
 	Validators Validators
 }
 
+// Output is where output of daemons and timers goes
+type Output struct {
+	Type    string
+	Path    string
+	Prefix  string
+	MaxSize string
+	Backups int
+}
+
+// Health is the health check of a daemon
+type Health struct {
+	Type      string
+	Url       string
+	Address   string
+	Lang      string
+	Code      string
+	Interval  uint32
+	Timeout   uint32
+	Threshold int
+	Grace     uint32
+}
+
+// Ready is how to tell a started daemon is ready for daemons depending on it.
+// Wait is the max seconds to wait.
+type Ready struct {
+	Health
+	Wait uint32
+}
+
 type Lock struct {
 	Name    string
 	Timeout uint
 	Wait    bool
+	Permits int
+	Mode    string
+	File    string
 }
 
 type Files struct {
@@ -89,15 +182,42 @@ type Timer struct {
 	Code     string
 	User     string
 	Tick     int
+	Cron     string
+	Timezone string
 	Deadline uint32
+	Overlap  string
+	Jitter   uint32
+	History  int
+	Stdout   Output
+	Stderr   Output
+	Env      []Env
+	Workdir  string
+	CleanEnv bool
+	Limits   Limits
+	Lock     Lock
 }
 
 type Daemon struct {
-	Lang    string
-	Code    string
-	User    string
-	Retries int
-	Live    int
+	Lang        string
+	Code        string
+	User        string
+	Retries     int
+	Live        int
+	Restart     string
+	Backoff     uint32
+	MaxBackoff  uint32
+	StopSignal  string
+	StopTimeout uint32
+	Stdout      Output
+	Stderr      Output
+	Health      Health
+	Depends     []string
+	Ready       Ready
+	Env         []Env
+	Workdir     string
+	CleanEnv    bool
+	Limits      Limits
+	Lock        Lock
 }
 
 type Validator struct {
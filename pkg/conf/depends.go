@@ -0,0 +1,57 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// isListSeparator splits lists like "a,b c"
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// DaemonOrder sorts daemons so that each daemon follows the daemons it depends on.
+// It fails if a dependency is not defined or dependencies are in a cycle.
+func DaemonOrder(daemons map[string]*Daemon) ([]string, error) {
+	names := make([]string, 0, len(daemons))
+	for name, daemon := range daemons {
+		for _, dep := range daemon.Depends {
+			if _, ok := daemons[dep]; !ok {
+				return nil, fmt.Errorf("daemon %s depends on undefined daemon %s", name, dep)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(daemons))
+	ret := make([]string, 0, len(daemons))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("daemon dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		}
+		marks[name] = visiting
+		for _, dep := range daemons[name].Depends {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		ret = append(ret, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,103 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	LockModeShared    = "shared"
+	LockModeExclusive = "exclusive"
+)
+
+const (
+	LockKindMutex     = "mutex"
+	LockKindSemaphore = "semaphore"
+	LockKindRW        = "rw"
+	LockKindFile      = "file"
+)
+
+// Kind returns which kind of lock the config makes
+func (self *Lock) Kind() string {
+	switch {
+	case self.File != "":
+		return LockKindFile
+	case self.Mode != "":
+		return LockKindRW
+	case self.Permits > 1:
+		return LockKindSemaphore
+	default:
+		return LockKindMutex
+	}
+}
+
+func (self *Lock) describe() string {
+	switch self.Kind() {
+	case LockKindSemaphore, LockKindRW:
+		return fmt.Sprintf("%s with %d permits", self.Kind(), self.Permits)
+	default:
+		return self.Kind()
+	}
+}
+
+type lockUser struct {
+	owner string
+	lock  *Lock
+}
+
+// lockUsers returns commands, daemons and timers with their locks, sorted by them
+func lockUsers(config *Config) []lockUser {
+	users := make([]lockUser, 0)
+	for group, commands := range config.Commands {
+		for name, command := range commands.Commands {
+			users = append(users, lockUser{fmt.Sprintf("command %s/%s", group, name), &command.Lock})
+		}
+	}
+	for name, daemon := range config.Daemons {
+		users = append(users, lockUser{"daemon " + name, &daemon.Lock})
+	}
+	for name, timer := range config.Timers {
+		users = append(users, lockUser{"timer " + name, &timer.Lock})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].owner < users[j].owner })
+	return users
+}
+
+// Locks returns the first config seen of each lock name,
+// which makes the same lock as other configs of the name after CheckLocks
+func Locks(config *Config) map[string]*Lock {
+	ret := make(map[string]*Lock)
+	for _, user := range lockUsers(config) {
+		if _, ok := ret[user.lock.Name]; !ok && user.lock.Name != "" {
+			ret[user.lock.Name] = user.lock
+		}
+	}
+	return ret
+}
+
+// CheckLocks checks modes of locks, and that configs of the same lock name make the same lock,
+// as a lock is created by the first config seen
+func CheckLocks(config *Config) error {
+	seen := make(map[string]lockUser)
+	for _, user := range lockUsers(config) {
+		lock := user.lock
+		if lock.Name == "" {
+			continue
+		}
+		switch lock.Mode {
+		case "", LockModeShared, LockModeExclusive:
+		default:
+			return fmt.Errorf("unknown mode %s of lock %s of %s", lock.Mode, lock.Name, user.owner)
+		}
+		first, ok := seen[lock.Name]
+		if !ok {
+			seen[lock.Name] = user
+			continue
+		}
+		if lock.describe() != first.lock.describe() {
+			return fmt.Errorf("lock %s of %s is %s, but of %s is %s",
+				lock.Name, user.owner, lock.describe(), first.owner, first.lock.describe())
+		}
+	}
+	return nil
+}
@@ -26,24 +26,51 @@ type XConfig struct {
 }
 
 type XServer struct {
-	Listen string `xml:"listen"`
-	Auth   XAuth  `xml:"auth"`
-	Log    string `xml:"log"`
+	Listen          string `xml:"listen"`
+	Auth            XAuth  `xml:"auth"`
+	Jobs            XJobs  `xml:"jobs"`
+	Log             string `xml:"log"`
+	ShutdownTimeout uint32 `xml:"shutdownTimeout"`
+	ReadTimeout     uint32 `xml:"readTimeout"`
+	WriteTimeout    uint32 `xml:"writeTimeout"`
+	IdleTimeout     uint32 `xml:"idleTimeout"`
+	MaxHeaderBytes  int    `xml:"maxHeaderBytes"`
+	TLS             XTLS   `xml:"tls"`
+}
+
+type XTLS struct {
+	ClientAuth string `xml:"clientAuth,attr"`
+	Cert       string `xml:"cert"`
+	Key        string `xml:"key"`
+	ClientCA   string `xml:"clientCA"`
 }
 
 type XAuth struct {
-	Enabled      bool   `xml:"enabled,attr"`
-	MaxTimeDelta uint32 `xml:"maxTimeDelta"`
+	Enabled        bool     `xml:"enabled,attr"`
+	MaxTimeDelta   uint32   `xml:"maxTimeDelta"`
+	Legacy         *bool    `xml:"legacy,attr"`
+	MaxNonces      int      `xml:"maxNonces"`
+	TrustedProxies []string `xml:"trustedProxy"`
+}
+
+type XJobs struct {
+	Max       int    `xml:"max,attr"`
+	Retention uint32 `xml:"retention,attr"`
+	Output    int    `xml:"output,attr"`
 }
 
 type XUser struct {
 	Name      string           `xml:"id,attr"`
 	Hosts     []string         `xml:"host"`
 	Key       string           `xml:"key"`
+	Certs     []string         `xml:"cert"`
+	Admin     bool             `xml:"admin,attr"`
 	Files     []XUserFiles     `xml:"files"`
 	Commands  []XUserCommands  `xml:"commands"`
 	Databases []XUserDatabases `xml:"databases"`
 	Vars      []XUserVars      `xml:"vars"`
+	Timers    []XUserTimers    `xml:"timers"`
+	Daemons   []XUserDaemons   `xml:"daemons"`
 }
 
 type XCommands struct {
@@ -58,10 +85,31 @@ type XCommand struct {
 	Timeout    uint32       `xml:"timeout,attr"`
 	User       string       `xml:"runas,attr"`
 	Background bool         `xml:"background,attr"`
+	Stream     bool         `xml:"stream,attr"`
+	Stderr     string       `xml:"stderr,attr"`
+	Output     string       `xml:"output,attr"`
+	Env        []XEnv       `xml:"env"`
+	Workdir    string       `xml:"workdir,attr"`
+	CleanEnv   bool         `xml:"cleanenv,attr"`
+	Limits     XLimits      `xml:"limits"`
 	Validator  []XValidator `xml:"validate"`
 	Lock       XLock        `xml:"lock"`
 }
 
+type XLimits struct {
+	Memory string `xml:"memory,attr"`
+	Cpu    int    `xml:"cpu,attr"`
+	Nofile uint64 `xml:"nofile,attr"`
+	Nproc  uint64 `xml:"nproc,attr"`
+	Nice   int    `xml:"nice,attr"`
+	Ionice string `xml:"ionice,attr"`
+}
+
+type XEnv struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
 type XDatabase struct {
 	Name    string   `xml:"id,attr"`
 	Driver  string   `xml:"driver,attr"`
@@ -79,6 +127,17 @@ type XLock struct {
 	Name    string `xml:"id,attr"`
 	Timeout uint   `xml:"timeout,attr"`
 	Wait    bool   `xml:"wait,attr"`
+	Permits int    `xml:"permits,attr"`
+	Mode    string `xml:"mode,attr"`
+	File    string `xml:"file,attr"`
+}
+
+type XOutput struct {
+	Type    string `xml:"type,attr"`
+	Path    string `xml:"path,attr"`
+	Prefix  string `xml:"prefix,attr"`
+	MaxSize string `xml:"maxsize,attr"`
+	Backups int    `xml:"backups,attr"`
 }
 
 type XFiles struct {
@@ -108,37 +167,99 @@ type XVar struct {
 }
 
 type XTimer struct {
-	Name     string `xml:"id,attr"`
-	Lang     string `xml:"lang,attr"`
-	Code     string `xml:"code"`
-	User     string `xml:"runas,attr"`
-	Tick     int    `xml:"tick,attr"`
-	Deadline uint32 `xml:"deadline,attr"`
+	Name     string  `xml:"id,attr"`
+	Lang     string  `xml:"lang,attr"`
+	Code     string  `xml:"code"`
+	User     string  `xml:"runas,attr"`
+	Tick     int     `xml:"tick,attr"`
+	Cron     string  `xml:"cron,attr"`
+	Timezone string  `xml:"timezone,attr"`
+	Deadline uint32  `xml:"deadline,attr"`
+	Overlap  string  `xml:"overlap,attr"`
+	Jitter   uint32  `xml:"jitter,attr"`
+	History  int     `xml:"history,attr"`
+	Stdout   XOutput `xml:"stdout"`
+	Stderr   XOutput `xml:"stderr"`
+	Env      []XEnv  `xml:"env"`
+	Workdir  string  `xml:"workdir,attr"`
+	CleanEnv bool    `xml:"cleanenv,attr"`
+	Limits   XLimits `xml:"limits"`
+	Lock     XLock   `xml:"lock"`
 }
 
 type XDaemon struct {
-	Name    string `xml:"id,attr"`
-	Lang    string `xml:"lang,attr"`
-	Code    string `xml:"code"`
-	User    string `xml:"runas,attr"`
-	Retries int    `xml:"retries,attr"`
-	Live    int    `xml:"live,attr"`
+	Name        string  `xml:"id,attr"`
+	Lang        string  `xml:"lang,attr"`
+	Code        string  `xml:"code"`
+	User        string  `xml:"runas,attr"`
+	Retries     int     `xml:"retries,attr"`
+	Live        int     `xml:"live,attr"`
+	Restart     string  `xml:"restart,attr"`
+	Backoff     uint32  `xml:"backoff,attr"`
+	MaxBackoff  uint32  `xml:"maxbackoff,attr"`
+	StopSignal  string  `xml:"stopsignal,attr"`
+	StopTimeout uint32  `xml:"stoptimeout,attr"`
+	Stdout      XOutput `xml:"stdout"`
+	Stderr      XOutput `xml:"stderr"`
+	Health      XHealth `xml:"health"`
+	Depends     string  `xml:"depends,attr"`
+	Ready       XReady  `xml:"ready"`
+	Env         []XEnv  `xml:"env"`
+	Workdir     string  `xml:"workdir,attr"`
+	CleanEnv    bool    `xml:"cleanenv,attr"`
+	Limits      XLimits `xml:"limits"`
+	Lock        XLock   `xml:"lock"`
+}
+
+type XHealth struct {
+	Type      string `xml:"type,attr"`
+	Url       string `xml:"url,attr"`
+	Address   string `xml:"address,attr"`
+	Lang      string `xml:"lang,attr"`
+	Code      string `xml:"code"`
+	Interval  uint32 `xml:"interval,attr"`
+	Timeout   uint32 `xml:"timeout,attr"`
+	Threshold int    `xml:"threshold,attr"`
+	Grace     uint32 `xml:"grace,attr"`
+}
+
+type XReady struct {
+	XHealth
+	Wait uint32 `xml:"wait,attr"`
 }
 
 type XUserFiles struct {
-	Name string `xml:"id,attr"`
+	Name    string `xml:"id,attr"`
+	Items   string `xml:"items,attr"`
+	Methods string `xml:"methods,attr"`
 }
 
 type XUserCommands struct {
-	Name string `xml:"id,attr"`
+	Name    string `xml:"id,attr"`
+	Items   string `xml:"items,attr"`
+	Methods string `xml:"methods,attr"`
 }
 
 type XUserDatabases struct {
-	Name string `xml:"id,attr"`
+	Name    string `xml:"id,attr"`
+	Items   string `xml:"items,attr"`
+	Methods string `xml:"methods,attr"`
 }
 
 type XUserVars struct {
-	Name string `xml:"id,attr"`
+	Name    string `xml:"id,attr"`
+	Items   string `xml:"items,attr"`
+	Methods string `xml:"methods,attr"`
+}
+
+type XUserTimers struct {
+	Name    string `xml:"id,attr"`
+	Control bool   `xml:"control,attr"`
+}
+
+type XUserDaemons struct {
+	Name    string `xml:"id,attr"`
+	Control bool   `xml:"control,attr"`
 }
 
 type XValidator struct {
@@ -185,11 +306,32 @@ func (conf *XConfig) ToConfig() *Config {
 func (conf *XConfig) IntoConfig(ret *Config) {
 	if ret.Server.Listen == "" {
 		ret.Server = Server{
-			Listen: conf.Server.Listen,
+			Listen:          conf.Server.Listen,
+			ShutdownTimeout: conf.Server.ShutdownTimeout,
+			ReadTimeout:     conf.Server.ReadTimeout,
+			WriteTimeout:    conf.Server.WriteTimeout,
+			IdleTimeout:     conf.Server.IdleTimeout,
+			MaxHeaderBytes:  conf.Server.MaxHeaderBytes,
+			TLS: TLS{
+				Cert:       strings.TrimSpace(conf.Server.TLS.Cert),
+				Key:        strings.TrimSpace(conf.Server.TLS.Key),
+				ClientCA:   strings.TrimSpace(conf.Server.TLS.ClientCA),
+				ClientAuth: strings.ToLower(strings.TrimSpace(conf.Server.TLS.ClientAuth)),
+			},
 		}
 		ret.Auth = Auth{
 			Enabled:      conf.Server.Auth.Enabled,
 			MaxTimeDelta: conf.Server.Auth.MaxTimeDelta,
+			Legacy:       conf.Server.Auth.Legacy == nil || *conf.Server.Auth.Legacy,
+			MaxNonces:    conf.Server.Auth.MaxNonces,
+		}
+		for _, proxy := range conf.Server.Auth.TrustedProxies {
+			ret.Auth.TrustedProxies = append(ret.Auth.TrustedProxies, strings.TrimSpace(proxy))
+		}
+		ret.Jobs = Jobs{
+			Max:       conf.Server.Jobs.Max,
+			Retention: conf.Server.Jobs.Retention,
+			Output:    conf.Server.Jobs.Output,
 		}
 		ret.Log = conf.Server.Log
 	}
@@ -235,20 +377,20 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 			if command.Timeout == 0 {
 				command.Timeout = math.MaxUint32
 			}
-			if command.Lock.Timeout == 0 {
-				command.Lock.Timeout = math.MaxUint32
-			}
 			ret.Commands[csname].Commands[cname] = &Command{
 				Code:       strings.TrimSpace(command.Code),
 				Lang:       command.Lang,
 				User:       command.User,
 				Timeout:    command.Timeout,
 				Background: command.Background,
-				Lock: Lock{
-					Name:    strings.TrimSpace(command.Lock.Name),
-					Timeout: command.Lock.Timeout,
-					Wait:    command.Lock.Wait,
-				},
+				Stream:     command.Stream,
+				Stderr:     strings.ToLower(strings.TrimSpace(command.Stderr)),
+				Output:     strings.ToLower(strings.TrimSpace(command.Output)),
+				Env:        xenvsToEnvs(command.Env),
+				Workdir:    strings.TrimSpace(command.Workdir),
+				CleanEnv:   command.CleanEnv,
+				Limits:     xlimitsToLimits(command.Limits),
+				Lock:       xlockToLock(command.Lock),
 				Validators: xvalidatorsToValidators(command.Validator),
 			}
 		}
@@ -299,11 +441,26 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 			daemon.Live = math.MaxUint32
 		}
 		ret.Daemons[daemon.Name] = &Daemon{
-			Code:    daemon.Code,
-			Lang:    daemon.Lang,
-			User:    daemon.User,
-			Live:    daemon.Live,
-			Retries: daemon.Retries,
+			Code:        daemon.Code,
+			Lang:        daemon.Lang,
+			User:        daemon.User,
+			Live:        daemon.Live,
+			Retries:     daemon.Retries,
+			Restart:     strings.ToLower(strings.TrimSpace(daemon.Restart)),
+			Backoff:     daemon.Backoff,
+			MaxBackoff:  daemon.MaxBackoff,
+			StopSignal:  strings.ToUpper(strings.TrimSpace(daemon.StopSignal)),
+			StopTimeout: daemon.StopTimeout,
+			Stdout:      xoutputToOutput(daemon.Stdout),
+			Stderr:      xoutputToOutput(daemon.Stderr),
+			Health:      xhealthToHealth(daemon.Health),
+			Depends:     strings.FieldsFunc(daemon.Depends, isListSeparator),
+			Ready:       Ready{Health: xhealthToHealth(daemon.Ready.XHealth), Wait: daemon.Ready.Wait},
+			Env:         xenvsToEnvs(daemon.Env),
+			Workdir:     strings.TrimSpace(daemon.Workdir),
+			CleanEnv:    daemon.CleanEnv,
+			Limits:      xlimitsToLimits(daemon.Limits),
+			Lock:        xlockToLock(daemon.Lock),
 		}
 	}
 	if ret.Timers == nil {
@@ -318,7 +475,19 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 			Lang:     timer.Lang,
 			User:     timer.User,
 			Tick:     timer.Tick,
+			Cron:     strings.TrimSpace(timer.Cron),
+			Timezone: strings.TrimSpace(timer.Timezone),
 			Deadline: timer.Deadline,
+			Overlap:  strings.ToLower(strings.TrimSpace(timer.Overlap)),
+			Jitter:   timer.Jitter,
+			History:  timer.History,
+			Stdout:   xoutputToOutput(timer.Stdout),
+			Stderr:   xoutputToOutput(timer.Stderr),
+			Env:      xenvsToEnvs(timer.Env),
+			Workdir:  strings.TrimSpace(timer.Workdir),
+			CleanEnv: timer.CleanEnv,
+			Limits:   xlimitsToLimits(timer.Limits),
+			Lock:     xlockToLock(timer.Lock),
 		}
 	}
 	if ret.Users == nil {
@@ -328,32 +497,74 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		uname := user.Name
 		u := &User{
 			Key:   strings.TrimSpace(user.Key),
+			Admin: user.Admin,
 			Hosts: make([]string, len(user.Hosts)),
 		}
 		for j := range user.Hosts {
 			u.Hosts[j] = strings.TrimSpace(user.Hosts[j])
 		}
+		for _, cert := range user.Certs {
+			u.Certs = append(u.Certs, strings.TrimSpace(cert))
+		}
 		u.Allows = make(map[string][]string)
 		u.Allows["commands"] = make([]string, 0, 2)
 		u.Allows["files"] = make([]string, 0, 2)
 		u.Allows["databases"] = make([]string, 0, 2)
 		u.Allows["vars"] = make([]string, 0, 2)
+		u.Allows["timers"] = make([]string, 0, 2)
+		u.Controls = make(map[string][]string)
+		u.Controls["timers"] = make([]string, 0, 2)
+		u.Allows["daemons"] = make([]string, 0, 2)
+		u.Controls["daemons"] = make([]string, 0, 2)
+		u.Permissions = make(map[string][]Permission)
 		for _, command := range user.Commands {
-			u.Allows["commands"] = append(u.Allows["commands"], command.Name)
+			u.allow("commands", command.Name, command.Items, command.Methods)
 		}
 		for _, file := range user.Files {
-			u.Allows["files"] = append(u.Allows["files"], file.Name)
+			u.allow("files", file.Name, file.Items, file.Methods)
 		}
 		for _, database := range user.Databases {
-			u.Allows["databases"] = append(u.Allows["databases"], database.Name)
+			u.allow("databases", database.Name, database.Items, database.Methods)
 		}
 		for _, vars := range user.Vars {
-			u.Allows["vars"] = append(u.Allows["vars"], vars.Name)
+			u.allow("vars", vars.Name, vars.Items, vars.Methods)
+		}
+		for _, timer := range user.Timers {
+			u.Allows["timers"] = append(u.Allows["timers"], timer.Name)
+			if timer.Control {
+				u.Controls["timers"] = append(u.Controls["timers"], timer.Name)
+			}
+		}
+		for _, daemon := range user.Daemons {
+			u.Allows["daemons"] = append(u.Allows["daemons"], daemon.Name)
+			if daemon.Control {
+				u.Controls["daemons"] = append(u.Controls["daemons"], daemon.Name)
+			}
 		}
 		ret.Users[uname] = u
 	}
 }
 
+func (self *User) allow(resource, group, items, methods string) {
+	if !contains(self.Allows[resource], group) {
+		self.Allows[resource] = append(self.Allows[resource], group)
+	}
+	self.Permissions[resource] = append(self.Permissions[resource], Permission{
+		Group:   group,
+		Items:   strings.FieldsFunc(items, isListSeparator),
+		Methods: strings.FieldsFunc(strings.ToUpper(methods), isListSeparator),
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 type LoadConfigError struct {
 	paths  []string
@@ -371,6 +582,81 @@ func xvalidatorsToValidators(xs []XValidator) Validators {
 	return ret
 }
 
+func xenvsToEnvs(xs []XEnv) []Env {
+	ret := make([]Env, 0, len(xs))
+	for _, x := range xs {
+		ret = append(ret, Env{
+			Name:  strings.TrimSpace(x.Name),
+			Value: x.Value,
+		})
+	}
+	return ret
+}
+
+func xlockToLock(x XLock) Lock {
+	if x.Timeout == 0 {
+		x.Timeout = math.MaxUint32
+	}
+	return Lock{
+		Name:    strings.TrimSpace(x.Name),
+		Timeout: x.Timeout,
+		Wait:    x.Wait,
+		Permits: x.Permits,
+		Mode:    strings.ToLower(strings.TrimSpace(x.Mode)),
+		File:    strings.TrimSpace(x.File),
+	}
+}
+
+func xoutputToOutput(x XOutput) Output {
+	ret := Output{
+		Type:    strings.ToLower(strings.TrimSpace(x.Type)),
+		Path:    strings.TrimSpace(x.Path),
+		Prefix:  strings.TrimSpace(x.Prefix),
+		MaxSize: strings.TrimSpace(x.MaxSize),
+		Backups: x.Backups,
+	}
+	if ret.Type == "" && ret.Path != "" {
+		ret.Type = "file"
+	}
+	return ret
+}
+
+func xhealthToHealth(x XHealth) Health {
+	ret := Health{
+		Type:      strings.ToLower(strings.TrimSpace(x.Type)),
+		Url:       strings.TrimSpace(x.Url),
+		Address:   strings.TrimSpace(x.Address),
+		Lang:      x.Lang,
+		Code:      x.Code,
+		Interval:  x.Interval,
+		Timeout:   x.Timeout,
+		Threshold: x.Threshold,
+		Grace:     x.Grace,
+	}
+	if ret.Type == "" {
+		switch {
+		case ret.Url != "":
+			ret.Type = "http"
+		case ret.Address != "":
+			ret.Type = "tcp"
+		case strings.TrimSpace(ret.Code) != "":
+			ret.Type = "command"
+		}
+	}
+	return ret
+}
+
+func xlimitsToLimits(x XLimits) Limits {
+	return Limits{
+		Memory: strings.TrimSpace(x.Memory),
+		Cpu:    x.Cpu,
+		Nofile: x.Nofile,
+		Nproc:  x.Nproc,
+		Nice:   x.Nice,
+		Ionice: strings.ToLower(strings.TrimSpace(x.Ionice)),
+	}
+}
+
 type LoadConfigError struct {
 	Path string
 	Err  error
@@ -413,5 +699,9 @@ func LoadXmlConfig(files, dirs []string, params map[string]string) (config Confi
 			}
 		}
 	}
+	if _, err = DaemonOrder(config.Daemons); err != nil {
+		return
+	}
+	err = CheckLocks(&config)
 	return
 }
@@ -3,13 +3,16 @@ package conf
 import (
 	"math"
 	"sort"
+	"strings"
 	"testing"
 )
 
 func TestConfig(t *testing.T) {
 	data := `<?xml version="1.0" encoding="utf-8" ?>
 <config>
-	<server><listen>:2465</listen></server>
+	<server><listen>:2465</listen><auth enabled="1"><maxTimeDelta>60</maxTimeDelta><maxNonces>1000</maxNonces><trustedProxy> 10.0.0.1 </trustedProxy><trustedProxy>fd00::/8</trustedProxy></auth><writeTimeout>600</writeTimeout><maxHeaderBytes>4096</maxHeaderBytes>
+		<tls clientAuth="Require"><cert> /etc/servant/server.crt </cert><key>/etc/servant/server.key</key><clientCA>/etc/servant/ca.crt</clientCA></tls>
+	</server>
     <commands id="db1">
         <command id="foo">
             <code>echo hello</code>
@@ -20,6 +23,11 @@ func TestConfig(t *testing.T) {
         <command id="sleep" timeout="5">
            <code> sleep 1000</code>
         </command>
+        <command id="env" workdir="/tmp" cleanenv="true">
+           <code>env</code>
+           <env name=" FOO ">foo ${a}</env>
+           <env name="BAR">bar</env>
+        </command>
     </commands>
     <files id="db1">
         <dir id="binlog1">
@@ -34,8 +42,13 @@ func TestConfig(t *testing.T) {
     <user id="db_ha">
         <key>&_var.foo;</key>
         <host>10.200.180.11 </host>
+        <cert> db_ha.example.com </cert>
         <files id="db1" />
+        <files id="db2" items="binlog1, binlog2" methods="get head" />
         <commands id="db1" />
+        <timers id="t1" />
+        <timers id="t2" control="true" />
+        <daemons id="d1" control="true" />
     </user>
 </config>`
 	xconf, err := XConfigFromData([]byte(data), map[string]string{
@@ -52,11 +65,28 @@ func TestConfig(t *testing.T) {
 	}
 	if len(conf.Commands) != 1 {
 
+	}
+	if conf.Server.WriteTimeout != 600 || conf.Server.ReadTimeout != 0 || conf.Server.MaxHeaderBytes != 4096 {
+		t.Errorf("server conf wrong: %+v", conf.Server)
+	}
+	if tls := conf.Server.TLS; tls.Cert != "/etc/servant/server.crt" || tls.Key != "/etc/servant/server.key" ||
+		tls.ClientCA != "/etc/servant/ca.crt" || tls.ClientAuth != "require" {
+		t.Errorf("tls conf wrong: %+v", tls)
+	}
+	if !conf.Auth.Enabled || !conf.Auth.Legacy || conf.Auth.MaxTimeDelta != 60 || conf.Auth.MaxNonces != 1000 {
+		t.Errorf("auth conf wrong: %+v", conf.Auth)
+	}
+	xconf, err = XConfigFromData([]byte(`<config><server><listen>:2465</listen><auth enabled="1" legacy="0"/></server></config>`), nil)
+	if err != nil || xconf.ToConfig().Auth.Legacy {
+		t.Errorf("legacy auth should be disabled: %v", err)
+	}
+	if proxies := conf.Auth.TrustedProxies; len(proxies) != 2 || proxies[0] != "10.0.0.1" || proxies[1] != "fd00::/8" {
+		t.Errorf("trusted proxies wrong: %v", proxies)
 	}
 	if _, ok := conf.Commands["db1"]; !ok {
 		t.Errorf("commands name wrong")
 	}
-	if len(conf.Commands["db1"].Commands) != 3 {
+	if len(conf.Commands["db1"].Commands) != 4 {
 		t.Errorf("commands members wrong")
 		return
 	}
@@ -93,6 +123,14 @@ func TestConfig(t *testing.T) {
 		t.Errorf("timeout code wrong")
 	}
 
+	env := conf.Commands["db1"].Commands["env"]
+	if env.Workdir != "/tmp" || !env.CleanEnv {
+		t.Errorf("command workdir or cleanenv wrong")
+	}
+	if len(env.Env) != 2 || env.Env[0].Name != "FOO" || env.Env[0].Value != "foo ${a}" || env.Env[1].Name != "BAR" {
+		t.Errorf("command env wrong: %v", env.Env)
+	}
+
 	if len(conf.Files) != 1 {
 		t.Errorf("parse files failed")
 	}
@@ -127,6 +165,26 @@ func TestConfig(t *testing.T) {
 	if conf.Users["db_ha"].Key != "FOO" {
 		t.Error("entity parse wrong")
 	}
+	if certs := conf.Users["db_ha"].Certs; len(certs) != 1 || certs[0] != "db_ha.example.com" {
+		t.Errorf("user certs wrong: %v", certs)
+	}
+	if files := conf.Users["db_ha"].Allows["files"]; len(files) != 2 || files[1] != "db2" {
+		t.Errorf("files allows wrong: %v", files)
+	}
+	if perms := conf.Users["db_ha"].Permissions["files"]; len(perms) != 2 || len(perms[0].Items) != 0 ||
+		perms[1].Group != "db2" || len(perms[1].Items) != 2 || perms[1].Items[1] != "binlog2" ||
+		len(perms[1].Methods) != 2 || perms[1].Methods[0] != "GET" || perms[1].Methods[1] != "HEAD" {
+		t.Errorf("files permissions wrong: %+v", perms)
+	}
+	if timers := conf.Users["db_ha"].Allows["timers"]; len(timers) != 2 || timers[0] != "t1" {
+		t.Errorf("timers allows wrong: %v", timers)
+	}
+	if timers := conf.Users["db_ha"].Controls["timers"]; len(timers) != 1 || timers[0] != "t2" {
+		t.Errorf("timers controls wrong: %v", timers)
+	}
+	if daemons := conf.Users["db_ha"].Controls["daemons"]; len(daemons) != 1 || daemons[0] != "d1" {
+		t.Errorf("daemons controls wrong: %v", daemons)
+	}
 	//fmt.Printf("%v\n", conf)
 }
 
@@ -154,4 +212,95 @@ func TestFiles(t *testing.T) {
 	if len(conf.Timers) < 1 {
 		t.Errorf("timer conf should present")
 	}
+	daemon := conf.Daemons["yy"]
+	if daemon == nil || daemon.Restart != "always" || daemon.MaxBackoff != 30 || daemon.StopSignal != "INT" || daemon.StopTimeout != 30 {
+		t.Errorf("daemon conf error: %v", daemon)
+	}
+	if daemon.Stdout.Type != "file" || daemon.Stdout.Path != "/tmp/yy.log" || daemon.Stdout.MaxSize != "64M" || daemon.Stdout.Backups != 3 || daemon.Stderr.Type != "merge" {
+		t.Errorf("daemon output conf error: %v %v", daemon.Stdout, daemon.Stderr)
+	}
+	if health := daemon.Health; health.Type != "command" || health.Interval != 30 || health.Threshold != 3 || health.Grace != 60 || !strings.Contains(health.Code, "pgrep") {
+		t.Errorf("daemon health conf error: %v", health)
+	}
+	if ready := daemon.Ready; ready.Type != "command" || ready.Wait != 10 {
+		t.Errorf("daemon ready conf error: %v", ready)
+	}
+	if zz := conf.Daemons["zz"]; zz == nil || len(zz.Depends) != 1 || zz.Depends[0] != "yy" {
+		t.Errorf("daemon depends conf error: %v", zz)
+	}
+	daily := conf.Timers["daily"]
+	if daily == nil || daily.Cron != "0 3 * * *" || daily.Timezone != "UTC" || daily.Tick != 0 || daily.Overlap != "queue" || daily.Jitter != 60 {
+		t.Errorf("cron timer conf error: %v", daily)
+	}
+}
+
+func TestDaemonOrder(t *testing.T) {
+	daemons := map[string]*Daemon{
+		"a": {Depends: []string{"b", "c"}},
+		"b": {Depends: []string{"c"}},
+		"c": {},
+		"d": {},
+	}
+	order, err := DaemonOrder(daemons)
+	if err != nil {
+		t.Fatalf("order failed: %s", err)
+	}
+	if strings.Join(order, ",") != "c,b,a,d" {
+		t.Errorf("bad order: %v", order)
+	}
+	daemons["c"].Depends = []string{"a"}
+	if _, err = DaemonOrder(daemons); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle should fail: %v", err)
+	}
+	daemons["c"].Depends = []string{"x"}
+	if _, err = DaemonOrder(daemons); err == nil {
+		t.Error("undefined dependency should fail")
+	}
+
+	data := `<?xml version="1.0" encoding="utf-8" ?>
+<config>
+	<daemon id="a" depends="b, c"><code>true</code></daemon>
+	<daemon id="b" depends="a"><code>true</code></daemon>
+	<daemon id="c"><code>true</code></daemon>
+</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	config := xconf.ToConfig()
+	if deps := config.Daemons["a"].Depends; len(deps) != 2 || deps[0] != "b" || deps[1] != "c" {
+		t.Errorf("bad depends: %v", deps)
+	}
+	if _, err = DaemonOrder(config.Daemons); err == nil {
+		t.Error("cycle should fail")
+	}
+}
+
+func TestCheckLocks(t *testing.T) {
+	config := &Config{
+		Commands: map[string]*Commands{"g": {Commands: map[string]*Command{
+			"a": {Lock: Lock{Name: "l1", Mode: LockModeShared}},
+			"b": {Lock: Lock{Name: "l1", Mode: LockModeExclusive}},
+			"c": {Lock: Lock{Name: "l2", Permits: 3}},
+			"d": {Lock: Lock{Name: "l3"}},
+		}}},
+		Daemons: map[string]*Daemon{"d1": {Lock: Lock{Name: "l2", Permits: 3}}},
+		Timers:  map[string]*Timer{"t1": {Lock: Lock{Name: "l3", File: "/tmp/l3"}}},
+	}
+	if err := CheckLocks(config); err == nil || !strings.Contains(err.Error(), "l3") {
+		t.Errorf("file lock and mutex of the same name should conflict: %v", err)
+	}
+	config.Timers["t1"].Lock = Lock{Name: "l3"}
+	if err := CheckLocks(config); err != nil {
+		t.Errorf("locks should be fine: %s", err)
+	}
+	config.Daemons["d1"].Lock.Permits = 2
+	if err := CheckLocks(config); err == nil || !strings.Contains(err.Error(), "l2") {
+		t.Errorf("semaphores of different permits should conflict: %v", err)
+	}
+	config.Daemons["d1"].Lock.Permits = 3
+	config.Commands["g"].Commands["b"].Lock.Mode = "shard"
+	if err := CheckLocks(config); err == nil || !strings.Contains(err.Error(), "shard") {
+		t.Errorf("unknown mode should fail: %v", err)
+	}
 }
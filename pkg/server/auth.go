@@ -4,15 +4,21 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 /*
+ Legacy, when auth legacy is enabled:
  Authorization: user ts sha1(user + key + ts + method + uri)
 
+ Or signed with hmac-sha256, see signature.go
+
+ With a verified client certificate mapped to a user, Authorization can be omitted.
 */
 func (self *Session) auth() (username string, err error) {
 	defer func() {
@@ -24,8 +30,30 @@ func (self *Session) auth() (username string, err error) {
 	if !self.config.Auth.Enabled {
 		return "", nil
 	}
+	certUser, err := self.certUser()
+	if err != nil {
+		return "", err
+	}
 	authStr := self.req.Header.Get("Authorization")
-	reqUser, reqHash, ts, err := parseAuthHeader(authStr)
+	if authStr == "" && certUser != "" {
+		remoteHost := self.remoteHost()
+		if !checkHosts(remoteHost, self.config.Users[certUser].Hosts) {
+			return certUser, fmt.Errorf("remote host %s is denied", remoteHost)
+		}
+		return certUser, nil
+	}
+	var reqUser, reqHash string
+	var ts int64
+	var hmacAuth hmacAuth
+	useHmac := isHmacAuthHeader(authStr)
+	if useHmac {
+		hmacAuth, err = parseHmacAuthHeader(authStr)
+		reqUser, ts = hmacAuth.user, hmacAuth.ts
+	} else if self.config.Auth.Legacy {
+		reqUser, reqHash, ts, err = parseAuthHeader(authStr)
+	} else {
+		err = fmt.Errorf("legacy auth is disabled, use %s", HmacAuthScheme)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -33,9 +61,12 @@ func (self *Session) auth() (username string, err error) {
 	if !ok {
 		return "", fmt.Errorf("user %s not found", reqUser)
 	}
-	remoteHost := strings.Split(self.req.RemoteAddr, ":")[0]
+	if certUser != "" && certUser != reqUser {
+		return reqUser, fmt.Errorf("user %s does not match the client certificate", reqUser)
+	}
+	remoteHost := self.remoteHost()
 	if !checkHosts(remoteHost, user.Hosts) {
-		return reqUser, fmt.Errorf("remote host %s is denied", self.req.RemoteAddr)
+		return reqUser, fmt.Errorf("remote host %s is denied", remoteHost)
 	}
 	if user.Key != "" {
 		nowTs := time.Now().Unix()
@@ -43,6 +74,9 @@ func (self *Session) auth() (username string, err error) {
 		if nowTs-ts > int64(maxDelta) || ts-nowTs > int64(maxDelta) {
 			return reqUser, fmt.Errorf("timestamp delta too large")
 		}
+		if useHmac {
+			return reqUser, self.checkHmacSignature(&hmacAuth, user.Key, nowTs)
+		}
 		strToHash := reqUser + user.Key + strconv.FormatInt(ts, 10) + self.req.Method + self.req.RequestURI
 		sha1Sum := sha1.Sum([]byte(strToHash))
 		realHash := hex.EncodeToString(sha1Sum[:])
@@ -77,30 +111,151 @@ func checkPermission(group string, allows []string) bool {
 	return false
 }
 
-func (self *Session) checkPermission() bool {
+func matchPermission(permission *conf.Permission, group, item, method string) bool {
+	return permission.Group == group &&
+		(len(permission.Items) == 0 || checkPermission(item, permission.Items)) &&
+		(len(permission.Methods) == 0 || checkPermission(method, permission.Methods))
+}
+
+// checkPermission denies anything not allowed to the user, and tells why
+func (self *Session) checkPermission() error {
 	if self.username == "" {
-		return true
+		return nil
+	}
+	user := self.UserConfig()
+	resource := self.resource
+	supervised := resource == "timers" || resource == "daemons"
+	if resource == "locks" || resource == "reload" || (supervised && self.group == "") {
+		if !user.Admin {
+			return fmt.Errorf("user %s is not admin", self.username)
+		}
+		return nil
+	}
+	if supervised && self.req.Method != "GET" {
+		// controlling timers and daemons needs more than reading them
+		if !checkPermission(self.group, user.Controls[resource]) {
+			return fmt.Errorf("user %s can not control %s %s", self.username, resource, self.group)
+		}
+		return nil
 	}
-	return checkPermission(self.group, self.UserConfig().Allows[self.resource])
+	if resource == "jobs" {
+		// jobs are accessible to whom can run the commands
+		resource = "commands"
+	}
+	if !checkPermission(self.group, user.Allows[resource]) {
+		return fmt.Errorf("user %s can not access %s %s", self.username, resource, self.group)
+	}
+	inGroup := false
+	for i := range user.Permissions[resource] {
+		permission := &user.Permissions[resource][i]
+		if matchPermission(permission, self.group, self.item, self.req.Method) {
+			return nil
+		}
+		inGroup = inGroup || permission.Group == self.group
+	}
+	if inGroup {
+		return fmt.Errorf("user %s can not %s %s %s/%s", self.username, self.req.Method, resource, self.group, self.item)
+	}
+	return nil
+}
+
+// lookupHost resolves host names in hosts, replaced in tests
+var lookupHost = net.LookupHost
+
+// host names are resolved again after it
+const hostCacheTtl = 60 * time.Second
+
+type hostAddrs struct {
+	addrs  []string
+	expire time.Time
+}
+
+type hostCache struct {
+	sync.Mutex
+	hosts map[string]hostAddrs
+}
+
+var resolvedHosts = &hostCache{hosts: make(map[string]hostAddrs)}
+
+// lookup returns addresses of the host, which are cached for a while, failed or not
+func (self *hostCache) lookup(host string) []string {
+	now := time.Now()
+	self.Lock()
+	cached, ok := self.hosts[host]
+	self.Unlock()
+	if ok && now.Before(cached.expire) {
+		return cached.addrs
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		logger.Printf("WARN (_) [auth] lookup host %s failed: %s", host, err)
+	}
+	self.Lock()
+	self.hosts[host] = hostAddrs{addrs: addrs, expire: now.Add(hostCacheTtl)}
+	self.Unlock()
+	return addrs
+}
+
+// matchHost checks whether ip is of host, which can be a CIDR, an ip, or a host name
+func matchHost(ip net.IP, host string) bool {
+	if _, allowedNet, err := net.ParseCIDR(host); err == nil {
+		return allowedNet.Contains(ip)
+	}
+	if hostIp := net.ParseIP(host); hostIp != nil {
+		return hostIp.Equal(ip)
+	}
+	for _, addr := range resolvedHosts.lookup(host) {
+		if net.ParseIP(addr).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHosts(remoteAddr string, hosts []string) bool {
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil {
+		return false
+	}
+	for _, host := range hosts {
+		if matchHost(ip, host) {
+			return true
+		}
+	}
+	return false
 }
 
 func checkHosts(remoteAddr string, hosts []string) bool {
 	if len(hosts) <= 0 {
 		return true
 	}
-	ok := false
-	for _, host := range hosts {
-		_, allowedNet, err := net.ParseCIDR(host)
-		if err != nil {
+	return matchHosts(remoteAddr, hosts)
+}
+
+// remoteHost returns the client ip. When the request is from a trusted proxy,
+// it is the last one in X-Forwarded-For not of trusted proxies.
+func (self *Session) remoteHost() string {
+	host, _, err := net.SplitHostPort(self.req.RemoteAddr)
+	if err != nil {
+		host = self.req.RemoteAddr
+	}
+	proxies := self.config.Auth.TrustedProxies
+	if !matchHosts(host, proxies) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(self.req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
 			continue
 		}
-		if allowedNet.Contains(net.ParseIP(remoteAddr)) {
-			ok = true
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			addr = h
+		}
+		host = addr
+		if !matchHosts(addr, proxies) {
 			break
 		}
 	}
-	if !ok {
-		return false
-	}
-	return true
+	return host
 }
@@ -1,6 +1,19 @@
 package server
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestCheckPermission(t *testing.T) {
 	if !checkPermission("a", []string{"a", "b", "c"}) {
@@ -17,7 +30,100 @@ func TestCheckPermission(t *testing.T) {
 	}
 }
 
+func TestSessionCheckPermission(t *testing.T) {
+	config := &conf.Config{Users: map[string]*conf.User{
+		"admin": {Admin: true},
+		"ops": {
+			Allows:   map[string][]string{"timers": {"t1", "t2"}, "daemons": {"d1"}},
+			Controls: map[string][]string{"timers": {"t1"}, "daemons": {"d1"}},
+		},
+	}}
+	cases := []struct {
+		user, method, path string
+		allowed            bool
+	}{
+		{"", "POST", "/timers/t1/pause", true},
+		{"admin", "GET", "/timers", true},
+		{"ops", "GET", "/timers", false},
+		{"ops", "GET", "/locks", false},
+		{"ops", "POST", "/reload", false},
+		{"admin", "POST", "/reload", true},
+		{"ops", "GET", "/timers/t2/status", true},
+		{"ops", "GET", "/timers/t3/status", false},
+		{"ops", "POST", "/timers/t1/trigger", true},
+		{"ops", "POST", "/timers/t2/trigger", false},
+		{"ops", "GET", "/daemons", false},
+		{"ops", "GET", "/daemons/d1/status", true},
+		{"ops", "POST", "/daemons/d1/restart", true},
+		{"ops", "POST", "/daemons/d2/restart", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		resource, group, item, tail := parseUriPath(c.path)
+		sess := &Session{config: config, req: req, username: c.user, resource: resource, group: group, item: item, tail: tail}
+		if (sess.checkPermission() == nil) != c.allowed {
+			t.Errorf("permission of %s %s %s should be %v", c.user, c.method, c.path, c.allowed)
+		}
+	}
+}
+
+func TestSessionCheckItemPermission(t *testing.T) {
+	config := &conf.Config{Users: map[string]*conf.User{
+		"ops": {
+			Allows: map[string][]string{"files": {"db1", "db2"}, "commands": {"db1", "db2"}},
+			Permissions: map[string][]conf.Permission{
+				"files": {
+					{Group: "db1", Items: []string{"binlog1"}, Methods: []string{"GET", "HEAD"}},
+					{Group: "db1", Items: []string{"tmp"}},
+					{Group: "db2"},
+				},
+				"commands": {{Group: "db1", Items: []string{"status", "ping"}}},
+			},
+		},
+	}}
+	cases := []struct {
+		method, path string
+		allowed      bool
+	}{
+		{"GET", "/files/db1/binlog1/log-bin.000001", true},
+		{"HEAD", "/files/db1/binlog1/log-bin.000001", true},
+		{"DELETE", "/files/db1/binlog1/log-bin.000001", false},
+		{"DELETE", "/files/db1/tmp/x", true},
+		{"GET", "/files/db1/binlog2/x", false},
+		{"DELETE", "/files/db2/any/x", true},
+		{"GET", "/files/db3/binlog1/x", false},
+		{"GET", "/commands/db1/status", true},
+		{"POST", "/commands/db1/ping", true},
+		{"GET", "/commands/db1/drop", false},
+		{"GET", "/jobs/db1/ping", true},
+		{"GET", "/jobs/db1/drop", false},
+		{"GET", "/commands/db2/drop", true},
+		{"GET", "/databases/db1/q1", false},
+		{"GET", "/unknown/db1/x", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		resource, group, item, tail := parseUriPath(c.path)
+		sess := &Session{config: config, req: req, username: "ops", resource: resource, group: group, item: item, tail: tail}
+		if err := sess.checkPermission(); (err == nil) != c.allowed {
+			t.Errorf("permission of %s %s should be %v, got %v", c.method, c.path, c.allowed, err)
+		}
+	}
+	req := httptest.NewRequest("DELETE", "/files/db1/binlog1/x", nil)
+	sess := &Session{config: config, req: req, username: "ops", resource: "files", group: "db1", item: "binlog1"}
+	if err := sess.checkPermission(); err == nil || err.Error() != "user ops can not DELETE files db1/binlog1" {
+		t.Errorf("error message wrong: %v", err)
+	}
+}
+
 func TestCheckHosts(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		if host == "db1.example.com" {
+			return []string{"10.11.12.13", "fd00::13"}, nil
+		}
+		return nil, fmt.Errorf("no such host: %s", host)
+	}
 	if !checkHosts("10.11.12.13", []string{"10.0.0.0/8"}) {
 		t.Fail()
 	}
@@ -25,10 +131,9 @@ func TestCheckHosts(t *testing.T) {
 	if !checkHosts("10.11.12.13", []string{"10.11.12.13/32"}) {
 		t.Fail()
 	}
-	/*
-		if ! checkHosts("10.11.12.13", []string{"10.11.12.13"}) {
-			t.Fail()
-		}*/
+	if !checkHosts("10.11.12.13", []string{"10.11.12.13"}) {
+		t.Fail()
+	}
 
 	if checkHosts("10.11.12.13", []string{"10.11.12.254/32"}) {
 		t.Fail()
@@ -45,6 +150,64 @@ func TestCheckHosts(t *testing.T) {
 	if !checkHosts("10.11.12.13", []string{}) {
 		t.Fail()
 	}
+
+	if !checkHosts("::1", []string{"::1"}) {
+		t.Fail()
+	}
+
+	if !checkHosts("fd00::1:2", []string{"fd00::/8"}) {
+		t.Fail()
+	}
+
+	if checkHosts("fe80::1", []string{"fd00::/8", "10.0.0.0/8"}) {
+		t.Fail()
+	}
+
+	if !checkHosts("::ffff:10.11.12.13", []string{"10.0.0.0/8"}) {
+		t.Fail()
+	}
+
+	if !checkHosts("10.11.12.13", []string{"db1.example.com"}) || !checkHosts("fd00::13", []string{"db1.example.com"}) {
+		t.Fail()
+	}
+
+	if checkHosts("10.11.12.14", []string{"db1.example.com"}) {
+		t.Fail()
+	}
+
+	if checkHosts("xxxx", []string{"xxxx"}) {
+		t.Fail()
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	config := &conf.Config{Auth: conf.Auth{TrustedProxies: []string{"10.0.0.1", "fd00::/8"}}}
+	cases := []struct {
+		remoteAddr string
+		forwarded  []string
+		host       string
+	}{
+		{"10.11.12.13:1234", nil, "10.11.12.13"},
+		{"[::1]:1234", nil, "::1"},
+		{"10.11.12.13:1234", []string{"192.168.0.1"}, "10.11.12.13"},
+		{"10.0.0.1:1234", []string{"192.168.0.1"}, "192.168.0.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"[fd00::1]:1234", []string{"192.168.0.1, 10.0.0.1"}, "192.168.0.1"},
+		{"10.0.0.1:1234", []string{"172.16.0.1, 192.168.0.1", "fd00::2"}, "192.168.0.1"},
+		{"10.0.0.1:1234", []string{"[2001:db8::1]:4321"}, "2001:db8::1"},
+		{"10.0.0.1:1234", []string{"10.0.0.1"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/commands/db1/foo", nil)
+		req.RemoteAddr = c.remoteAddr
+		for _, forwarded := range c.forwarded {
+			req.Header.Add("X-Forwarded-For", forwarded)
+		}
+		sess := &Session{config: config, req: req}
+		if host := sess.remoteHost(); host != c.host {
+			t.Errorf("remote host of %s %v should be %s, got %s", c.remoteAddr, c.forwarded, c.host, host)
+		}
+	}
 }
 
 func TestParseAuthHeader(t *testing.T) {
@@ -63,3 +226,172 @@ func TestParseAuthHeader(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// signRequest signs req as clients do, body is nil for requests without body.
+// Set the nonce header before signing to use a nonce.
+func signRequest(req *http.Request, user, key string, ts int64, signedHeaders []string, body []byte) {
+	digest := sha256.Sum256(body)
+	req.Header.Set(ServantContentSha256Header, hex.EncodeToString(digest[:]))
+	auth := hmacAuth{user: user, ts: ts, signedHeaders: signedHeaders}
+	signature := hmacSignature(key, hmacStringToSign(req, &auth, req.Header.Get(ServantContentSha256Header)))
+	req.Header.Set("Authorization", fmt.Sprintf("%s User=%s, Timestamp=%d, SignedHeaders=%s, Signature=%s",
+		HmacAuthScheme, user, ts, strings.Join(signedHeaders, ";"), signature))
+}
+
+func TestParseHmacAuthHeader(t *testing.T) {
+	auth, err := parseHmacAuthHeader(HmacAuthScheme + " User=u1, Timestamp=123, SignedHeaders=Host;X-Foo, Signature=ABC")
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if auth.user != "u1" || auth.ts != 123 || auth.signature != "abc" ||
+		len(auth.signedHeaders) != 2 || auth.signedHeaders[0] != "host" || auth.signedHeaders[1] != "x-foo" {
+		t.Errorf("parse wrong: %+v", auth)
+	}
+	for _, bad := range []string{
+		"",
+		"u1 123 abc",
+		HmacAuthScheme + " User=u1, Timestamp=123",
+		HmacAuthScheme + " User=u1, Timestamp=x, Signature=abc",
+		HmacAuthScheme + " Timestamp=123, Signature=abc",
+		HmacAuthScheme + " User=u1, Timestamp=123, Signature=abc, Foo=bar",
+		HmacAuthScheme + " User=u1, Timestamp=123, Signature",
+	} {
+		if _, err := parseHmacAuthHeader(bad); err == nil {
+			t.Errorf("%q should be bad", bad)
+		}
+	}
+}
+
+func TestHmacAuth(t *testing.T) {
+	// nonces used here are remembered by a cache of the test
+	defer func(old *nonceCache) {
+		nonces = old
+	}(nonces)
+	nonces = newNonceCache(conf.Auth{})
+	config := &conf.Config{
+		Auth:  conf.Auth{Enabled: true, MaxTimeDelta: 300},
+		Users: map[string]*conf.User{"u1": {Key: "k1"}},
+	}
+	now := time.Now().Unix()
+	newSession := func(body []byte) *Session {
+		req := httptest.NewRequest("POST", "/commands/db1/foo?a=1", bytes.NewReader(body))
+		req.Header.Set("X-Foo", "foo")
+		return &Session{config: config, req: req, resp: httptest.NewRecorder()}
+	}
+	check := func(sess *Session, ok bool, msg string) {
+		username, err := sess.auth()
+		if ok && (err != nil || username != "u1") {
+			t.Errorf("%s: should pass, got %q %v", msg, username, err)
+		} else if !ok && err == nil {
+			t.Errorf("%s: should fail", msg)
+		}
+	}
+
+	body := []byte("hello")
+	sess := newSession(body)
+	signRequest(sess.req, "u1", "k1", now, []string{"host", "x-foo"}, body)
+	check(sess, true, "signed")
+	if read, _ := ioutil.ReadAll(sess.req.Body); !bytes.Equal(read, body) {
+		t.Errorf("body should be kept: %q", read)
+	}
+
+	sess = newSession(nil)
+	signRequest(sess.req, "u1", "k1", now, nil, nil)
+	check(sess, true, "signed without body")
+
+	big := bytes.Repeat([]byte("x"), maxMemoryBody+10)
+	sess = newSession(big)
+	signRequest(sess.req, "u1", "k1", now, nil, big)
+	check(sess, true, "signed with large body")
+	if read, _ := ioutil.ReadAll(sess.req.Body); !bytes.Equal(read, big) {
+		t.Errorf("large body should be kept: %d bytes", len(read))
+	}
+	sess.req.Body.Close()
+
+	sess = newSession([]byte("hellO"))
+	signRequest(sess.req, "u1", "k1", now, nil, body)
+	check(sess, false, "body changed")
+
+	sess = newSession(body)
+	signRequest(sess.req, "u1", "k1", now, []string{"x-foo"}, body)
+	sess.req.Header.Set("X-Foo", "bar")
+	check(sess, false, "signed header changed")
+
+	sess = newSession(body)
+	signRequest(sess.req, "u1", "k2", now, nil, body)
+	check(sess, false, "wrong key")
+
+	sess = newSession(body)
+	signRequest(sess.req, "u1", "k1", now-1000, nil, body)
+	check(sess, false, "timestamp expired")
+
+	sess = newSession(body)
+	signRequest(sess.req, "u1", "k1", now, nil, body)
+	sess.req.Header.Del(ServantContentSha256Header)
+	check(sess, false, "body digest missing")
+
+	sess = newSession(body)
+	sess.req.Header.Set(ServantNonceHeader, "n1")
+	signRequest(sess.req, "u1", "k1", now, nil, body)
+	replayed := newSession(body)
+	replayed.req.Header = sess.req.Header.Clone()
+	check(sess, true, "signed with nonce")
+	check(replayed, false, "replayed with nonce")
+
+	sess = newSession(body)
+	sess.req.Header.Set(ServantNonceHeader, "n2")
+	signRequest(sess.req, "u1", "k1", now, nil, body)
+	sess.req.Header.Set(ServantNonceHeader, "n3")
+	check(sess, false, "nonce changed")
+
+	legacyHeader := func(sess *Session) {
+		ts := fmt.Sprint(now)
+		sum := sha1.Sum([]byte("u1" + "k1" + ts + sess.req.Method + sess.req.RequestURI))
+		sess.req.Header.Set("Authorization", "u1 "+ts+" "+hex.EncodeToString(sum[:]))
+	}
+	sess = newSession(body)
+	legacyHeader(sess)
+	check(sess, false, "legacy disabled")
+
+	config.Auth.Legacy = true
+	sess = newSession(body)
+	legacyHeader(sess)
+	check(sess, true, "legacy enabled")
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := newNonceCache(conf.Auth{MaxNonces: 3})
+	if cache.add("u1", "a", 110, 100) != nil {
+		t.Fail()
+	}
+	if cache.add("u1", "a", 110, 105) == nil {
+		t.Errorf("used nonce should be denied")
+	}
+	if cache.add("u2", "a", 110, 105) != nil {
+		t.Errorf("nonces of users are separated")
+	}
+	if cache.add("u1", "a", 120, 111) != nil {
+		t.Errorf("expired nonce can be used again")
+	}
+	if cache.add("u1", "b", 125, 111) != nil || cache.add("u1", "c", 130, 111) != nil {
+		t.Fail()
+	}
+	if cache.add("u1", "d", 130, 112) == nil {
+		t.Errorf("should be denied when full of nonces not expired")
+	}
+	if cache.add("u3", "d", 130, 112) != nil {
+		t.Errorf("other users should not be denied when a user is full")
+	}
+	// only u1 a is expired
+	if cache.add("u1", "d", 130, 121) != nil || cache.size() != 5 {
+		t.Errorf("expired nonces should be purged, size: %d", cache.size())
+	}
+	// nonces of other users are purged when they add nonces
+	if cache.add("u1", "e", 140, 131) != nil || cache.size() != 3 {
+		t.Errorf("all expired nonces of u1 should be purged, size: %d", cache.size())
+	}
+	cache.configure(conf.Auth{})
+	if cache.max != defaultMaxNonces {
+		t.Errorf("default max nonces wrong: %d", cache.max)
+	}
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
-	"github.com/pkg/errors"
+	"encoding/json"
+	"fmt"
 	"github.com/xiezhenye/servant/pkg/conf"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"os/exec"
 	"os/user"
 	"regexp"
@@ -78,17 +80,34 @@ func (self CommandServer) serve() {
 		self.ErrorEnd(http.StatusNotFound, "command %s not found", urlPath)
 		return
 	}
-	if cmdConf.Lock.Name == "" {
+	lockConf, err := expandLockConf(cmdConf.Lock, requestParams(self.req))
+	if err != nil {
+		self.ErrorEnd(http.StatusBadRequest, "%s", err)
+		return
+	}
+	owner := LockOwner{
+		Session:  self.id,
+		Username: self.username,
+		Command:  self.req.URL.Path,
+	}
+	if !cmdConf.Background {
+		// the command may run longer than the server timeouts
+		d := time.Duration(cmdConf.Timeout) * time.Second
+		if lockConf.Wait {
+			d += time.Duration(lockConf.Timeout) * time.Second
+		}
+		self.extendDeadline(d)
+	}
+	locked, err := withConfLock(&lockConf, owner, func() {
 		self.serveCommand(cmdConf)
-	} else {
-		if cmdConf.Lock.Wait {
-			GetLock(cmdConf.Lock.Name).TimeoutWith(time.Duration(cmdConf.Lock.Timeout)*time.Second, func() {
-				self.serveCommand(cmdConf)
-			})
+	})
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "lock %s not acquired: %s", lockConf.Name, err)
+	} else if !locked {
+		if lockConf.Wait {
+			self.ErrorEnd(http.StatusConflict, "lock %s not acquired: wait timeout after %d seconds", lockConf.Name, lockConf.Timeout)
 		} else {
-			GetLock(cmdConf.Lock.Name).TryWith(func() {
-				self.serveCommand(cmdConf)
-			})
+			self.ErrorEnd(http.StatusConflict, "lock %s not acquired: held by others", lockConf.Name)
 		}
 	}
 }
@@ -113,18 +132,72 @@ func setCmdUser(cmd *exec.Cmd, username string) error {
 }
 
 func (self CommandServer) serveCommand(cmdConf *conf.Command) {
-	outBuf, err := self.execCommand(cmdConf)
+	if cmdConf.Background {
+		self.serveJob(cmdConf)
+		return
+	}
+	if cmdConf.Stream {
+		self.streamCommand(cmdConf)
+		return
+	}
+	result, err := self.execCommand(cmdConf)
 	if err != nil {
-		if sErr, ok := err.(ServantError); ok {
-			self.ErrorEnd(sErr.HttpCode, sErr.Message)
-		} else {
-			self.ErrorEnd(500, err.Error())
-		}
+		self.servantErrorEnd(err)
 		return
 	}
-	_, err = self.resp.Write(outBuf) // may log errors
+	self.writeResult(cmdConf, result)
+}
+
+func (self CommandServer) servantErrorEnd(err error) {
+	if sErr, ok := err.(ServantError); ok {
+		self.ErrorEnd(sErr.HttpCode, sErr.Message)
+	} else {
+		self.ErrorEnd(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (self CommandServer) newCmd(cmdConf *conf.Command) (*exec.Cmd, io.ReadCloser, error) {
+	var input io.ReadCloser = nil
+	if self.req.Method == "POST" {
+		input = self.req.Body
+	}
+	cmd, out, err := cmdFromConf(cmdConf, requestParams(self.req), input)
+	if err != nil {
+		return nil, nil, err
+	}
+	self.info("command: %v", cmd.Args)
+	return cmd, out, nil
+}
+
+func (self CommandServer) writeResult(cmdConf *conf.Command, result *cmdResult) {
+	header := self.resp.Header()
+	header.Set(ServantExitCodeHeader, strconv.Itoa(result.ExitCode))
+	if result.Signal != 0 {
+		header.Set(ServantSignalHeader, strconv.Itoa(result.Signal))
+	}
+	code := http.StatusOK
+	if !result.Success() {
+		code = http.StatusBadGateway
+		header.Set(ServantErrHeader, result.ErrorMessage())
+	}
+	body := result.Stdout
+	if cmdConf.Output == "json" {
+		var err error
+		body, err = json.Marshal(result.Envelope())
+		if err != nil {
+			self.ErrorEnd(http.StatusInternalServerError, "json marshal failed: %s", err)
+			return
+		}
+		header.Set("Content-Type", "application/json")
+	} else if len(result.Stderr) > 0 {
+		self.warn("stderr: %s", truncateOutput(result.Stderr, maxLoggedOutput))
+	}
+	self.resp.WriteHeader(code)
+	_, err := self.resp.Write(body) // may log errors
 	if err != nil {
 		self.BadEnd("io error: %s", err)
+	} else if code != http.StatusOK {
+		self.BadEnd(result.ErrorMessage())
 	} else {
 		self.GoodEnd("execution done")
 	}
@@ -154,9 +227,33 @@ func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (
 		err = NewServantError(http.StatusInternalServerError, "unknown language")
 		return
 	}
+	switch cmdConf.Stderr {
+	case "", "discard", "separate", "merge":
+	default:
+		err = NewServantError(http.StatusInternalServerError, "unknown stderr mode: %s", cmdConf.Stderr)
+		return
+	}
+	switch cmdConf.Output {
+	case "", "raw", "json":
+	default:
+		err = NewServantError(http.StatusInternalServerError, "unknown output format: %s", cmdConf.Output)
+		return
+	}
 	cmd = exec.Command(name, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.Dir = "/"
+	if cmdConf.Workdir != "" {
+		dir, exists := replaceCmdParams(cmdConf.Workdir, params)
+		if !exists {
+			err = NewServantError(http.StatusBadRequest, "some params missing")
+			return
+		}
+		cmd.Dir = dir
+	}
+	cmd.Env, err = cmdEnv(cmdConf, params)
+	if err != nil {
+		return
+	}
 	if cmdConf.User != "" {
 		err = setCmdUser(cmd, cmdConf.User)
 		if err != nil {
@@ -179,67 +276,222 @@ func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (
 			err = NewServantError(http.StatusInternalServerError, "pipe stdout failed: %s", err.Error())
 			return
 		}
+		if cmdConf.Stderr == "merge" {
+			cmd.Stderr = cmd.Stdout
+		}
+	}
+	err = prepareLimits(cmd, &cmdConf.Limits)
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		err = NewServantError(http.StatusInternalServerError, "set limits failed: %s", err.Error())
+		return
 	}
 	return cmd, out, nil
 }
 
-func (self CommandServer) execCommand(cmdConf *conf.Command) (outBuf []byte, err error) {
-	var input io.ReadCloser = nil
-	if self.req.Method == "POST" {
-		input = self.req.Body
+// cmdEnv returns nil to inherit servant's environment when nothing is configured
+func cmdEnv(cmdConf *conf.Command, params ParamFunc) ([]string, error) {
+	if len(cmdConf.Env) == 0 && !cmdConf.CleanEnv {
+		return nil, nil
+	}
+	var env []string
+	if cmdConf.CleanEnv {
+		env = make([]string, 0, len(cmdConf.Env))
+	} else {
+		env = os.Environ()
+	}
+	for _, e := range cmdConf.Env {
+		v, exists := replaceCmdParams(e.Value, params)
+		if !exists {
+			return nil, NewServantError(http.StatusBadRequest, "some params missing in env %s", e.Name)
+		}
+		env = append(env, e.Name+"="+v)
 	}
-	params := requestParams(self.req)
-	cmd, out, err := cmdFromConf(cmdConf, params, input)
+	return env, nil
+}
+
+func (self CommandServer) execCommand(cmdConf *conf.Command) (result *cmdResult, err error) {
+	cmd, out, err := self.newCmd(cmdConf)
 	if err != nil {
 		return
 	}
-	self.info("command: %v", cmd.Args)
 	if out != nil {
 		defer out.Close()
 	}
-	err = cmd.Start()
+	var errBuf *limitedBuffer
+	if cmdConf.Stderr == "separate" {
+		errBuf = newLimitedBuffer(maxLoggedOutput)
+		cmd.Stderr = errBuf
+	}
+	t0 := time.Now()
+	limits, err := startCmd(cmd, &cmdConf.Limits)
 	if err != nil {
 		err = NewServantError(http.StatusBadGateway, "execution error: %s", err)
 		return
 	}
-	self.info("process started. pid: %d", cmd.Process.Pid)
-	if cmdConf.Background {
-		go func() {
-			err = cmd.Wait()
-			if err != nil {
-				self.warn("background process %d ended with error: %s", cmd.Process.Pid, err.Error())
-			} else {
-				self.info("background process %d ended", cmd.Process.Pid)
-			}
-		}()
-	} else {
-		ch := make(chan error, 1)
-		go func() {
-			if out != nil {
-				if outBuf, err = ioutil.ReadAll(out); err != nil {
-					ch <- err
-					_ = cmd.Wait()
-					return
-				}
-				if err = cmd.Wait(); err != nil {
-					ch <- errors.WithMessage(err, string(outBuf))
-					return
-				}
-				ch <- nil
-				return
-			}
-			ch <- cmd.Wait()
-		}()
-		timeout := time.Duration(cmdConf.Timeout)
-		select {
-		case err = <-ch:
-			if err != nil {
-				err = NewServantError(http.StatusBadGateway, "execution error: %s", err)
+	self.info("process started. pid: %d%s", cmd.Process.Pid, limitsSuffix(limits))
+	registerProcess(cmd)
+	ch := make(chan error, 1)
+	var outBuf []byte
+	go func() {
+		var rErr error
+		if out != nil {
+			outBuf, rErr = ioutil.ReadAll(out)
+		}
+		wErr := cmd.Wait()
+		unregisterProcess(cmd)
+		releaseLimits(cmd)
+		if rErr != nil {
+			ch <- rErr
+			return
+		}
+		ch <- wErr
+	}()
+	timeout := time.Duration(cmdConf.Timeout)
+	select {
+	case err = <-ch:
+		if _, exited := err.(*exec.ExitError); err != nil && !exited {
+			return nil, NewServantError(http.StatusBadGateway, "execution error: %s", err)
+		}
+		result = newCmdResult(cmd.ProcessState, time.Since(t0))
+		result.Stdout = outBuf
+		if errBuf != nil {
+			result.Stderr = []byte(errBuf.String())
+		}
+		return result, nil
+	case <-time.After(timeout * time.Second):
+		_ = cmd.Process.Kill()
+		return nil, NewServantError(http.StatusGatewayTimeout, "command execution timeout: %d", timeout)
+	}
+}
+
+const streamBufSize = 32 * 1024
+
+// streamCommand writes stdout to the response as soon as it is produced.
+// Headers are sent before the command ends, so the exit status is reported in trailers.
+func (self CommandServer) streamCommand(cmdConf *conf.Command) {
+	cmd, out, err := self.newCmd(cmdConf)
+	if err != nil {
+		self.servantErrorEnd(err)
+		return
+	}
+	defer out.Close()
+	var errBuf *limitedBuffer
+	if cmdConf.Stderr == "separate" {
+		errBuf = newLimitedBuffer(maxLoggedOutput)
+		cmd.Stderr = errBuf
+	}
+	limits, err := startCmd(cmd, &cmdConf.Limits)
+	if err != nil {
+		self.ErrorEnd(http.StatusBadGateway, "execution error: %s", err)
+		return
+	}
+	self.info("process started. pid: %d%s", cmd.Process.Pid, limitsSuffix(limits))
+	registerProcess(cmd)
+	timeout := time.Duration(cmdConf.Timeout)
+	timer := time.AfterFunc(timeout*time.Second, func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	self.resp.Header().Set("Trailer", ServantExitCodeHeader+", "+ServantSignalHeader+", "+ServantErrHeader)
+	self.resp.WriteHeader(http.StatusOK)
+	flusher, _ := self.resp.(http.Flusher)
+	var ioErr error
+	buf := make([]byte, streamBufSize)
+	for {
+		n, rErr := out.Read(buf)
+		if n > 0 && ioErr == nil {
+			if _, ioErr = self.resp.Write(buf[:n]); ioErr != nil {
+				// client gone, nobody is reading the output any more
+				_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			} else if flusher != nil {
+				flusher.Flush()
 			}
-		case <-time.After(timeout * time.Second):
-			_ = cmd.Process.Kill()
-			err = NewServantError(http.StatusGatewayTimeout, "command execution timeout: %d", timeout)
 		}
+		if rErr != nil {
+			break
+		}
+	}
+	err = cmd.Wait()
+	unregisterProcess(cmd)
+	releaseLimits(cmd)
+	timedOut := !timer.Stop()
+	if errBuf != nil && errBuf.Len() > 0 {
+		self.warn("stderr: %s", errBuf.String())
+	}
+	var result *cmdResult
+	if cmd.ProcessState != nil {
+		result = newCmdResult(cmd.ProcessState, 0)
+		self.resp.Header().Set(ServantExitCodeHeader, strconv.Itoa(result.ExitCode))
+		if result.Signal != 0 {
+			self.resp.Header().Set(ServantSignalHeader, strconv.Itoa(result.Signal))
+		}
+	}
+	switch {
+	case ioErr != nil:
+		self.BadEnd("io error: %s", ioErr)
+	case timedOut:
+		msg := fmt.Sprintf("command execution timeout: %d", timeout)
+		self.resp.Header().Set(ServantErrHeader, msg)
+		self.BadEnd(msg)
+	case result != nil && !result.Success():
+		self.resp.Header().Set(ServantErrHeader, result.ErrorMessage())
+		self.BadEnd(result.ErrorMessage())
+	case err != nil:
+		msg := fmt.Sprintf("execution error: %s", err)
+		self.resp.Header().Set(ServantErrHeader, msg)
+		self.BadEnd(msg)
+	default:
+		self.GoodEnd("execution done")
+	}
+}
+
+type cmdResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Signal   int
+	Duration time.Duration
+}
+
+type cmdEnvelope struct {
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	ExitCode int     `json:"exit_code"`
+	Signal   int     `json:"signal,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+func newCmdResult(state *os.ProcessState, duration time.Duration) *cmdResult {
+	ret := &cmdResult{
+		ExitCode: state.ExitCode(),
+		Duration: duration,
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		ret.Signal = int(status.Signal())
+	}
+	return ret
+}
+
+func (self *cmdResult) Success() bool {
+	return self.ExitCode == 0 && self.Signal == 0
+}
+
+func (self *cmdResult) ErrorMessage() string {
+	if self.Signal != 0 {
+		return fmt.Sprintf("command killed by signal %d (%s)", self.Signal, syscall.Signal(self.Signal))
+	}
+	return fmt.Sprintf("command exited with code %d", self.ExitCode)
+}
+
+func (self *cmdResult) Envelope() cmdEnvelope {
+	return cmdEnvelope{
+		Stdout:   string(self.Stdout),
+		Stderr:   string(self.Stderr),
+		ExitCode: self.ExitCode,
+		Signal:   self.Signal,
+		Duration: self.Duration.Seconds(),
 	}
-	return
 }
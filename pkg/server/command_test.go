@@ -1,7 +1,12 @@
 package server
 
 import (
+	"encoding/json"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -19,3 +24,172 @@ func TestGetCmdExecArgs(t *testing.T) {
 		t.Error("args wrong")
 	}
 }
+
+func TestStreamCommand(t *testing.T) {
+	req := httptest.NewRequest("GET", "/commands/g/c", nil)
+	resp := httptest.NewRecorder()
+	server := CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.streamCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "echo hello; echo world; exit 3",
+		Timeout: 5,
+		Stream:  true,
+	})
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Errorf("status should be 200: %d", result.StatusCode)
+	}
+	if resp.Body.String() != "hello\nworld\n" {
+		t.Errorf("output wrong: %q", resp.Body.String())
+	}
+	if !resp.Flushed {
+		t.Error("output should be flushed")
+	}
+	if result.Trailer.Get(ServantExitCodeHeader) != "3" {
+		t.Errorf("exit code trailer wrong: %q", result.Trailer.Get(ServantExitCodeHeader))
+	}
+}
+
+func TestServeCommandResult(t *testing.T) {
+	req := httptest.NewRequest("GET", "/commands/g/c", nil)
+	resp := httptest.NewRecorder()
+	server := CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "echo out; echo err >&2; exit 3",
+		Timeout: 5,
+		Stderr:  "separate",
+		Output:  "json",
+	})
+	if resp.Code != http.StatusBadGateway {
+		t.Errorf("status should be 502: %d", resp.Code)
+	}
+	if resp.Header().Get(ServantExitCodeHeader) != "3" {
+		t.Errorf("exit code header wrong: %q", resp.Header().Get(ServantExitCodeHeader))
+	}
+	var envelope cmdEnvelope
+	if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("bad envelope: %s", err)
+	}
+	if envelope.Stdout != "out\n" || envelope.Stderr != "err\n" || envelope.ExitCode != 3 {
+		t.Errorf("envelope wrong: %+v", envelope)
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "head -c 2000 /dev/zero | tr '\\0' x >&2",
+		Timeout: 5,
+		Stderr:  "separate",
+		Output:  "json",
+	})
+	envelope = cmdEnvelope{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("bad envelope: %s", err)
+	}
+	if len(envelope.Stderr) != maxLoggedOutput+3 || !strings.HasSuffix(envelope.Stderr, "x...") {
+		t.Errorf("stderr should be truncated: %d", len(envelope.Stderr))
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "echo out; echo err >&2",
+		Timeout: 5,
+		Stderr:  "merge",
+	})
+	if resp.Code != http.StatusOK || resp.Header().Get(ServantExitCodeHeader) != "0" {
+		t.Errorf("should succeed: %d", resp.Code)
+	}
+	if resp.Body.String() != "out\nerr\n" {
+		t.Errorf("output wrong: %q", resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "kill -9 $$",
+		Timeout: 5,
+	})
+	if resp.Header().Get(ServantSignalHeader) != "9" {
+		t.Errorf("signal header wrong: %q", resp.Header().Get(ServantSignalHeader))
+	}
+}
+
+func TestCmdFromConfEnv(t *testing.T) {
+	params := func(k string) (string, bool) {
+		if k == "a" {
+			return "X", true
+		}
+		return "", false
+	}
+	cmd, _, err := cmdFromConf(&conf.Command{
+		Code:     "env",
+		Workdir:  "/tmp/${a}",
+		CleanEnv: true,
+		Env:      []conf.Env{{Name: "FOO", Value: "foo ${a}"}},
+	}, params, nil)
+	if err != nil {
+		t.Fatalf("create command failed: %s", err)
+	}
+	if cmd.Dir != "/tmp/X" {
+		t.Errorf("workdir wrong: %s", cmd.Dir)
+	}
+	if !reflect.DeepEqual(cmd.Env, []string{"FOO=foo X"}) {
+		t.Errorf("env wrong: %v", cmd.Env)
+	}
+
+	cmd, _, err = cmdFromConf(&conf.Command{Code: "env"}, params, nil)
+	if err != nil || cmd.Env != nil || cmd.Dir != "/" {
+		t.Errorf("env should be inherited: %v", cmd.Env)
+	}
+
+	_, _, err = cmdFromConf(&conf.Command{
+		Code: "env",
+		Env:  []conf.Env{{Name: "FOO", Value: "${b}"}},
+	}, params, nil)
+	if err == nil {
+		t.Error("missing param should fail")
+	}
+}
+
+func TestServeLockConflict(t *testing.T) {
+	cmdConf := &conf.Command{
+		Lang:    "bash",
+		Code:    "echo hello",
+		Timeout: 5,
+		Lock:    conf.Lock{Name: "test_conflict", Timeout: 1},
+	}
+	config := &conf.Config{Commands: map[string]*conf.Commands{
+		"g": {Commands: map[string]*conf.Command{"c": cmdConf}},
+	}}
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/commands/g/c", nil)
+		resp := httptest.NewRecorder()
+		NewCommandServer(&Session{config: config, req: req, resp: resp, resource: "commands", group: "g", item: "c"}).serve()
+		return resp
+	}
+	if resp := serve(); resp.Code != http.StatusOK || resp.Body.String() != "hello\n" {
+		t.Errorf("should run: %d", resp.Code)
+	}
+	GetLock("test_conflict").With(func() {
+		resp := serve()
+		if resp.Code != http.StatusConflict {
+			t.Errorf("should conflict: %d", resp.Code)
+		}
+		if resp.Header().Get(ServantErrHeader) != "lock test_conflict not acquired: held by others" {
+			t.Errorf("message wrong: %s", resp.Header().Get(ServantErrHeader))
+		}
+		cmdConf.Lock.Wait = true
+		resp = serve()
+		if resp.Code != http.StatusConflict {
+			t.Errorf("should conflict: %d", resp.Code)
+		}
+		if resp.Header().Get(ServantErrHeader) != "lock test_conflict not acquired: wait timeout after 1 seconds" {
+			t.Errorf("message wrong: %s", resp.Header().Get(ServantErrHeader))
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression. Each field is a bit set of allowed values.
+type CronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	// when either of day of month and day of week is *, both must match, otherwise either matches
+	domStar, dowStar bool
+	location         *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDowNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var (
+	cronSecondField = cronField{"second", 0, 59, nil}
+	cronMinuteField = cronField{"minute", 0, 59, nil}
+	cronHourField   = cronField{"hour", 0, 23, nil}
+	cronDomField    = cronField{"day of month", 1, 31, nil}
+	cronMonthField  = cronField{"month", 1, 12, cronMonthNames}
+	// 7 is also sunday
+	cronDowField = cronField{"day of week", 0, 7, cronDowNames}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronYearsToSearch limits the search of next time for expressions like 0 0 30 2 *
+const cronYearsToSearch = 5
+
+// ParseCron parses a 5 fields (minute hour dom month dow) or 6 fields (with second first) cron expression.
+// The expression may be prefixed with CRON_TZ=<zone> to override the timezone.
+func ParseCron(expr string, timezone string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "CRON_TZ=") {
+		i := strings.IndexAny(expr, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("bad cron expression: %s", expr)
+		}
+		timezone = expr[len("CRON_TZ="):i]
+		expr = strings.TrimSpace(expr[i:])
+	}
+	location := time.Local
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron expression should have 5 or 6 fields: %s", expr)
+	}
+	ret := &CronSchedule{location: location}
+	var err error
+	if ret.second, _, err = parseCronField(fields[0], cronSecondField); err != nil {
+		return nil, err
+	}
+	if ret.minute, _, err = parseCronField(fields[1], cronMinuteField); err != nil {
+		return nil, err
+	}
+	if ret.hour, _, err = parseCronField(fields[2], cronHourField); err != nil {
+		return nil, err
+	}
+	if ret.dom, ret.domStar, err = parseCronField(fields[3], cronDomField); err != nil {
+		return nil, err
+	}
+	if ret.month, _, err = parseCronField(fields[4], cronMonthField); err != nil {
+		return nil, err
+	}
+	if ret.dow, ret.dowStar, err = parseCronField(fields[5], cronDowField); err != nil {
+		return nil, err
+	}
+	if ret.dow&(1<<7) != 0 {
+		ret.dow |= 1
+	}
+	return ret, nil
+}
+
+func parseCronValue(s string, field cronField) (int, error) {
+	if v, ok := field.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < field.min || v > field.max {
+		return 0, fmt.Errorf("bad %s: %s", field.name, s)
+	}
+	return v, nil
+}
+
+func parseCronField(s string, field cronField) (bits uint64, star bool, err error) {
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, false, fmt.Errorf("bad %s step: %s", field.name, part)
+			}
+			part = part[:i]
+		}
+		var lo, hi int
+		switch {
+		case part == "*" || part == "?":
+			lo, hi = field.min, field.max
+			star = true
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			if lo, err = parseCronValue(part[:i], field); err != nil {
+				return 0, false, err
+			}
+			if hi, err = parseCronValue(part[i+1:], field); err != nil {
+				return 0, false, err
+			}
+			if lo > hi {
+				return 0, false, fmt.Errorf("bad %s range: %s", field.name, part)
+			}
+		default:
+			if lo, err = parseCronValue(part, field); err != nil {
+				return 0, false, err
+			}
+			hi = lo
+			if step > 1 {
+				// 5/10 means from 5 to max every 10
+				hi = field.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, star, nil
+}
+
+func cronMatch(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (self *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cronMatch(self.dom, t.Day())
+	dowMatch := cronMatch(self.dow, int(t.Weekday()))
+	if self.domStar || self.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// cronForward makes sure the search goes forward when midnight is skipped by daylight saving time
+func cronForward(from, to time.Time) time.Time {
+	if !to.After(from) {
+		return to.Add(time.Hour)
+	}
+	return to
+}
+
+// Next returns the first time matches the schedule after t, or zero time if not found.
+func (self *CronSchedule) Next(t time.Time) time.Time {
+	loc := self.location
+	t = t.In(loc).Truncate(time.Second).Add(time.Second)
+	yearLimit := t.Year() + cronYearsToSearch
+	for t.Year() <= yearLimit {
+		if !cronMatch(self.month, int(t.Month())) {
+			t = cronForward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !self.dayMatches(t) {
+			t = cronForward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !cronMatch(self.hour, t.Hour()) {
+			// not time.Date, as hours skipped by daylight saving time would be mapped backward
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+			continue
+		}
+		if !cronMatch(self.minute, t.Minute()) {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if !cronMatch(self.second, t.Second()) {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
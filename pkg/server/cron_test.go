@@ -0,0 +1,148 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"testing"
+	"time"
+)
+
+func TestParseCronError(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * foo *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"@every",
+		"CRON_TZ=Nowhere/Nothing * * * * *",
+	} {
+		if _, err := ParseCron(expr, ""); err == nil {
+			t.Errorf("%q should be invalid", expr)
+		}
+	}
+	if _, err := ParseCron("* * * * *", "Nowhere/Nothing"); err == nil {
+		t.Errorf("bad timezone should be invalid")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2024, 1, 15, 10, 20, 30, 500, time.UTC) // monday
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 15, 10, 21, 0, 0, time.UTC)},
+		{"* * * * * *", time.Date(2024, 1, 15, 10, 20, 31, 0, time.UTC)},
+		{"*/15 * * * * *", time.Date(2024, 1, 15, 10, 20, 45, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 1, 16, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon", time.Date(2024, 1, 22, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, 1, 21, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * SAT,SUN", time.Date(2024, 1, 20, 9, 0, 0, 0, time.UTC)},
+		{"30 10-12/2 * * *", time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 jun ?", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 15, 10, 25, 0, 0, time.UTC)},
+		// either day of month or day of week matches
+		{"0 0 1 * fri", time.Date(2024, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr, "UTC")
+		if err != nil {
+			t.Errorf("parse %q failed: %s", c.expr, err)
+			continue
+		}
+		if next := cron.Next(base); !next.Equal(c.next) {
+			t.Errorf("next of %q should be %s, got %s", c.expr, c.next, next)
+		}
+	}
+}
+
+func TestCronTimezone(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+	base := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC) // 08:00 in Shanghai
+	expected := time.Date(2024, 1, 16, 3, 0, 0, 0, shanghai)
+	for _, c := range []struct{ expr, timezone string }{
+		{"0 3 * * *", "Asia/Shanghai"},
+		{"CRON_TZ=Asia/Shanghai 0 3 * * *", ""},
+		{"CRON_TZ=Asia/Shanghai 0 3 * * *", "UTC"},
+	} {
+		cron, err := ParseCron(c.expr, c.timezone)
+		if err != nil {
+			t.Fatalf("parse %q failed: %s", c.expr, err)
+		}
+		if next := cron.Next(base); !next.Equal(expected) {
+			t.Errorf("next of %q in %q should be %s, got %s", c.expr, c.timezone, expected, next)
+		}
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+	cron, _ := ParseCron("30 2 * * *", "America/New_York")
+	// 02:30 does not exist on 2024-03-10
+	next := cron.Next(time.Date(2024, 3, 9, 12, 0, 0, 0, ny))
+	if expected := time.Date(2024, 3, 11, 2, 30, 0, 0, ny); !next.Equal(expected) {
+		t.Errorf("next should be %s, got %s", expected, next)
+	}
+	cron, _ = ParseCron("0 * * * *", "America/New_York")
+	next = cron.Next(time.Date(2024, 3, 10, 1, 30, 0, 0, ny))
+	if expected := time.Date(2024, 3, 10, 3, 0, 0, 0, ny); !next.Equal(expected) {
+		t.Errorf("next should be %s, got %s", expected, next)
+	}
+	// 01:00 occurs twice on 2024-11-03
+	first := time.Date(2024, 11, 3, 0, 30, 0, 0, ny)
+	next = cron.Next(first)
+	if d := next.Sub(first); d != 30*time.Minute {
+		t.Errorf("next should be 30 minutes later, got %s", d)
+	}
+	if d := cron.Next(next).Sub(next); d != time.Hour {
+		t.Errorf("next should be 1 hour later, got %s", d)
+	}
+}
+
+func TestTimerSchedule(t *testing.T) {
+	if _, err := timerSchedule(&conf.Timer{}); err == nil {
+		t.Errorf("tick or cron should be required")
+	}
+	if _, err := timerSchedule(&conf.Timer{Cron: "bad"}); err == nil {
+		t.Errorf("bad cron should fail")
+	}
+	tick, err := timerSchedule(&conf.Timer{Tick: 5})
+	if err != nil {
+		t.Fatalf("tick schedule failed: %s", err)
+	}
+	now := time.Now()
+	next := tick(now)
+	if d := next.Sub(now); d <= 0 || d > 5*time.Second {
+		t.Errorf("bad next tick: %s", d)
+	}
+	if d := tick(next).Sub(next); d != 5*time.Second {
+		t.Errorf("ticks should be 5s apart, got %s", d)
+	}
+	cron, err := timerSchedule(&conf.Timer{Tick: 5, Cron: "@hourly"})
+	if err != nil {
+		t.Fatalf("cron schedule failed: %s", err)
+	}
+	if next := cron(now); next.Minute() != 0 || next.Second() != 0 {
+		t.Errorf("cron should take precedence over tick, got %s", next)
+	}
+}
@@ -0,0 +1,761 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DaemonStarting = "starting"
+	DaemonRunning  = "running"
+	DaemonBackoff  = "backoff"
+	DaemonFailed   = "failed"
+	DaemonStopped  = "stopped"
+)
+
+const (
+	DaemonRestartAlways    = "always"
+	DaemonRestartOnFailure = "on-failure"
+	DaemonRestartNever     = "never"
+)
+
+const defaultDaemonBackoff = 1
+const defaultDaemonMaxBackoff = 60
+const defaultDaemonStopTimeout = 10
+const defaultDaemonReadyWait = 60
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal parses signal names like TERM, SIGTERM, or numbers
+func parseSignal(s string) (syscall.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n >= 65 {
+		return 0, fmt.Errorf("bad signal: %s", s)
+	}
+	return syscall.Signal(n), nil
+}
+
+type daemonExit struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exit_code"`
+	Signal   int       `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type daemonStatus struct {
+	Name     string      `json:"name"`
+	State    string      `json:"state"`
+	Pid      int         `json:"pid,omitempty"`
+	Since    time.Time   `json:"since"`
+	Uptime   float64     `json:"uptime"`
+	Restarts int         `json:"restarts"`
+	LastExit *daemonExit `json:"last_exit,omitempty"`
+	// health check of the running process
+	Health         string `json:"health,omitempty"`
+	HealthFailures int    `json:"health_failures,omitempty"`
+	HealthError    string `json:"health_error,omitempty"`
+}
+
+// Daemon supervises a daemon process, restarts it when it fails.
+type Daemon struct {
+	sync.Mutex
+	name        string
+	conf        *conf.Daemon
+	cmdConf     conf.Command
+	lockConf    conf.Lock
+	restart     string
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	stopSignal  syscall.Signal
+	stopTimeout time.Duration
+	output      *taskOutput
+	health      *healthCheck
+	// nil if the daemon is ready once started
+	ready     *healthCheck
+	readyWait time.Duration
+	state     string
+	pid       int
+	since     time.Time
+	restarts  int
+	lastExit  *daemonExit
+	stopping  bool
+	// health of the running process
+	healthState    string
+	healthFailures int
+	healthError    string
+	// the running process is killed by health check
+	unhealthy bool
+	// wakes up the supervisor waiting to retry
+	wake chan struct{}
+	// closed when the supervisor ends, nil if not started
+	done chan struct{}
+}
+
+type daemonTable struct {
+	sync.Mutex
+	daemons map[string]*Daemon
+}
+
+var daemons = &daemonTable{daemons: make(map[string]*Daemon)}
+
+func (self *daemonTable) add(daemon *Daemon) {
+	self.Lock()
+	self.daemons[daemon.name] = daemon
+	self.Unlock()
+}
+
+// remove removes the daemon if it is not replaced
+func (self *daemonTable) remove(daemon *Daemon) {
+	self.Lock()
+	if self.daemons[daemon.name] == daemon {
+		delete(self.daemons, daemon.name)
+		daemon.output.close()
+	}
+	self.Unlock()
+}
+
+func (self *daemonTable) get(name string) *Daemon {
+	self.Lock()
+	defer self.Unlock()
+	return self.daemons[name]
+}
+
+func (self *daemonTable) list() []*Daemon {
+	self.Lock()
+	defer self.Unlock()
+	ret := make([]*Daemon, 0, len(self.daemons))
+	for _, daemon := range self.daemons {
+		ret = append(ret, daemon)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+func NewDaemon(name string, daemonConf *conf.Daemon) (*Daemon, error) {
+	ret, err := newDaemon(name, daemonConf)
+	if err != nil {
+		return nil, err
+	}
+	if ret.output, err = newTaskOutput("daemon", name, &daemonConf.Stdout, &daemonConf.Stderr); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// checkDaemon checks the config as NewDaemon does, without opening output files
+func checkDaemon(name string, daemonConf *conf.Daemon) error {
+	if _, err := newDaemon(name, daemonConf); err != nil {
+		return err
+	}
+	return checkTaskOutput(&daemonConf.Stdout, &daemonConf.Stderr)
+}
+
+// newDaemon creates the daemon without output
+func newDaemon(name string, daemonConf *conf.Daemon) (*Daemon, error) {
+	if daemonConf.Retries < 0 {
+		daemonConf.Retries = 0
+	}
+	lockConf, err := expandLockConf(daemonConf.Lock, requestParams(nil))
+	if err != nil {
+		return nil, err
+	}
+	restart := daemonConf.Restart
+	switch restart {
+	case "":
+		restart = DaemonRestartOnFailure
+	case DaemonRestartAlways, DaemonRestartOnFailure, DaemonRestartNever:
+	default:
+		return nil, fmt.Errorf("unknown restart policy: %s", restart)
+	}
+	stopSignal := syscall.SIGTERM
+	if daemonConf.StopSignal != "" {
+		var err error
+		if stopSignal, err = parseSignal(daemonConf.StopSignal); err != nil {
+			return nil, err
+		}
+	}
+	backoff, maxBackoff, stopTimeout := daemonConf.Backoff, daemonConf.MaxBackoff, daemonConf.StopTimeout
+	if backoff == 0 {
+		backoff = defaultDaemonBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultDaemonMaxBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	if stopTimeout == 0 {
+		stopTimeout = defaultDaemonStopTimeout
+	}
+	health, err := newHealthCheck(&daemonConf.Health, daemonConf)
+	if err != nil {
+		return nil, err
+	}
+	ready, err := newHealthCheck(&daemonConf.Ready.Health, daemonConf)
+	if err != nil {
+		return nil, err
+	}
+	if ready != nil && daemonConf.Ready.Interval == 0 {
+		ready.interval = time.Second
+	}
+	readyWait := daemonConf.Ready.Wait
+	if readyWait == 0 {
+		readyWait = defaultDaemonReadyWait
+	}
+	return &Daemon{
+		name: name,
+		conf: daemonConf,
+		cmdConf: conf.Command{
+			Lang:       daemonConf.Lang,
+			Code:       daemonConf.Code,
+			User:       daemonConf.User,
+			Background: true,
+			Env:        daemonConf.Env,
+			Workdir:    daemonConf.Workdir,
+			CleanEnv:   daemonConf.CleanEnv,
+			Limits:     daemonConf.Limits,
+		},
+		lockConf:    lockConf,
+		restart:     restart,
+		backoff:     time.Duration(backoff) * time.Second,
+		maxBackoff:  time.Duration(maxBackoff) * time.Second,
+		stopSignal:  stopSignal,
+		stopTimeout: time.Duration(stopTimeout) * time.Second,
+		health:      health,
+		ready:       ready,
+		readyWait:   time.Duration(readyWait) * time.Second,
+		state:       DaemonStopped,
+		since:       time.Now(),
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+func RunDaemon(name string, daemonConf *conf.Daemon) *Daemon {
+	daemon, err := NewDaemon(name, daemonConf)
+	if err != nil {
+		logger.Printf("WARN (_) [daemon] %s %s", name, err.Error())
+		return nil
+	}
+	daemons.add(daemon)
+	daemon.Start()
+	return daemon
+}
+
+type daemonGate struct {
+	// closed when the daemon is ready or given up
+	done chan struct{}
+	ok   bool
+}
+
+// startDaemons starts each daemon after the daemons it depends on are ready.
+// Dependencies are checked when loading config, so there is no cycle.
+func startDaemons(daemonConfs map[string]*conf.Daemon) {
+	gates := make(map[string]*daemonGate, len(daemonConfs))
+	for name := range daemonConfs {
+		gates[name] = &daemonGate{done: make(chan struct{})}
+	}
+	for name, daemonConf := range daemonConfs {
+		go func(name string, daemonConf *conf.Daemon) {
+			gate := gates[name]
+			defer close(gate.done)
+			for _, dep := range daemonConf.Depends {
+				depGate, ok := gates[dep]
+				if !ok {
+					continue
+				}
+				<-depGate.done
+				if !depGate.ok {
+					logger.Printf("WARN (_) [daemon] %s not started, as %s is not ready", name, dep)
+					return
+				}
+			}
+			daemon := RunDaemon(name, daemonConf)
+			gate.ok = daemon != nil && daemon.waitReady()
+		}(name, daemonConf)
+	}
+}
+
+// waitReady waits until the daemon is running and passes the ready check, returns false if it is not ready in time
+func (self *Daemon) waitReady() bool {
+	interval := 100 * time.Millisecond
+	if self.ready != nil {
+		interval = self.ready.interval
+	}
+	deadline := time.Now().Add(self.readyWait)
+	for {
+		status := self.Status()
+		switch status.State {
+		case DaemonFailed, DaemonStopped:
+			logger.Printf("WARN (_) [daemon] %s is %s before ready", self.name, status.State)
+			return false
+		case DaemonRunning:
+			if self.ready == nil {
+				return true
+			}
+			err := self.ready.check()
+			if err == nil {
+				logger.Printf("INFO (_) [daemon] %s is ready", self.name)
+				return true
+			}
+			logger.Printf("INFO (_) [daemon] %s is not ready: %s", self.name, err.Error())
+		}
+		if time.Now().After(deadline) {
+			logger.Printf("WARN (_) [daemon] %s is not ready in %s", self.name, self.readyWait)
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
+
+// setState must be called with lock held
+func (self *Daemon) setState(state string) {
+	if self.state != state {
+		self.state = state
+		self.since = time.Now()
+	}
+}
+
+func (self *Daemon) Start() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.done != nil {
+		return fmt.Errorf("daemon %s is already started", self.name)
+	}
+	logger.Printf("INFO (_) [daemon] starting daemon %s", self.name)
+	self.stopping = false
+	select {
+	case <-self.wake:
+	default:
+	}
+	self.setState(DaemonStarting)
+	self.done = make(chan struct{})
+	go self.supervise(self.done)
+	return nil
+}
+
+// Stop sends the stop signal to the daemon process, and kills it if it does not exit in the grace period.
+func (self *Daemon) Stop() error {
+	self.Lock()
+	done := self.done
+	if done == nil {
+		self.Unlock()
+		return fmt.Errorf("daemon %s is not started", self.name)
+	}
+	logger.Printf("INFO (_) [daemon] stopping daemon %s", self.name)
+	self.stopping = true
+	pid := self.pid
+	self.Unlock()
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+	if pid > 0 {
+		syscall.Kill(-pid, self.stopSignal)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(self.stopTimeout):
+	}
+	self.Lock()
+	pid = self.pid
+	self.Unlock()
+	if pid > 0 {
+		logger.Printf("WARN (_) [daemon] killing daemon %s. pid: %d", self.name, pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("daemon %s is not stopped in time", self.name)
+	}
+}
+
+// stopDaemons stops all daemons, each after the daemons depending on it are stopped
+func stopDaemons() {
+	stopDaemonList(daemons.list())
+}
+
+// stopDaemonList stops daemons in the list, each after the daemons in the list depending on it are stopped
+func stopDaemonList(list []*Daemon) {
+	stopped := make(map[string]chan struct{}, len(list))
+	dependents := make(map[string][]string)
+	for _, daemon := range list {
+		stopped[daemon.name] = make(chan struct{})
+	}
+	for _, daemon := range list {
+		for _, dep := range daemon.conf.Depends {
+			if _, ok := stopped[dep]; ok {
+				dependents[dep] = append(dependents[dep], daemon.name)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for _, daemon := range list {
+		wg.Add(1)
+		go func(daemon *Daemon) {
+			defer wg.Done()
+			for _, name := range dependents[daemon.name] {
+				<-stopped[name]
+			}
+			daemon.Stop()
+			close(stopped[daemon.name])
+		}(daemon)
+	}
+	wg.Wait()
+}
+
+func (self *Daemon) Restart() error {
+	// a daemon not started can be restarted too, failing to stop makes it fail to start
+	self.Stop()
+	return self.Start()
+}
+
+func (self *Daemon) isStopping() bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.stopping
+}
+
+// sleep returns false if waked up
+func (self *Daemon) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-self.wake:
+		return false
+	}
+}
+
+func (self *Daemon) supervise(done chan struct{}) {
+	name := self.name
+	owner := LockOwner{Command: "daemon:" + name}
+	state := DaemonFailed
+	defer func() {
+		self.Lock()
+		self.setState(state)
+		self.pid = 0
+		self.done = nil
+		self.Unlock()
+		close(done)
+	}()
+	exited := false
+	delay := self.backoff
+	for i := 0; i < self.conf.Retries+1; {
+		if isExiting() || self.isStopping() {
+			state = DaemonStopped
+			return
+		}
+		if exited {
+			self.Lock()
+			self.restarts++
+			self.Unlock()
+		}
+		started := false
+		var err error
+		var uptime time.Duration
+		locked, lockErr := withConfLock(&self.lockConf, owner, func() {
+			started, err, uptime = self.runCommand()
+		})
+		if self.isStopping() {
+			state = DaemonStopped
+			return
+		}
+		if lockErr != nil {
+			logger.Printf("WARN (_) [daemon] %s lock %s not acquired: %s", name, self.lockConf.Name, lockErr)
+		} else if !locked {
+			logger.Printf("WARN (_) [daemon] %s lock %s not acquired", name, self.lockConf.Name)
+		}
+		if !locked {
+			self.Lock()
+			self.setState(DaemonBackoff)
+			self.Unlock()
+			self.sleep(time.Second)
+			i++
+			continue
+		}
+		if !started {
+			return
+		}
+		exited = true
+		if err == nil {
+			logger.Printf("WARN (_) [daemon] %s normal exit", name)
+			if self.restart != DaemonRestartAlways {
+				state = DaemonStopped
+				return
+			}
+		} else {
+			logger.Printf("WARN (_) [daemon] %s exited: %s", name, err.Error())
+			if self.restart == DaemonRestartNever {
+				return
+			}
+			i++
+		}
+		if uptime >= time.Duration(self.conf.Live)*time.Second {
+			i = 0
+			delay = self.backoff
+		}
+		if i >= self.conf.Retries+1 {
+			break
+		}
+		logger.Printf("INFO (_) [daemon] %s restarting in %s", name, delay)
+		self.Lock()
+		self.setState(DaemonBackoff)
+		self.Unlock()
+		self.sleep(delay)
+		delay = nextBackoff(delay, self.maxBackoff)
+	}
+	logger.Printf("WARN (_) [daemon] %s give up after %d retries", name, self.conf.Retries)
+}
+
+func nextBackoff(delay, max time.Duration) time.Duration {
+	delay *= 2
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// runCommand runs the daemon process until it exits,
+// returns whether it is started, the error it exits with and how long it runs
+func (self *Daemon) runCommand() (bool, error, time.Duration) {
+	name := self.name
+	if self.isStopping() {
+		return false, nil, 0
+	}
+	cmd, out, err := cmdFromConf(&self.cmdConf, requestParams(nil), nil)
+	if out != nil {
+		out.Close()
+	}
+	if err != nil {
+		logger.Printf("WARN (_) [daemon] create %s command failed: %s", name, err.Error())
+		self.setExit(nil, err)
+		return false, err, 0
+	}
+	self.output.attach(cmd, nil)
+	logger.Printf("INFO (_) [daemon] command: %v", cmd.Args)
+	limits, err := startCmd(cmd, &self.cmdConf.Limits)
+	if err != nil {
+		logger.Printf("WARN (_) [daemon] start %s failed: %s", name, err.Error())
+		self.setExit(nil, err)
+		return false, err, 0
+	}
+	pid := cmd.Process.Pid
+	logger.Printf("INFO (_) [daemon] %s started. pid: %d%s", name, pid, limitsSuffix(limits))
+	t0 := time.Now()
+	self.Lock()
+	self.pid = pid
+	self.setState(DaemonRunning)
+	self.healthState, self.healthFailures, self.healthError, self.unhealthy = HealthUnknown, 0, "", false
+	stopping := self.stopping
+	self.Unlock()
+	if stopping {
+		syscall.Kill(-pid, self.stopSignal)
+	}
+	exited := make(chan struct{})
+	if self.health != nil {
+		go self.monitorHealth(pid, exited)
+	}
+	err = self.output.wait(cmd)
+	releaseLimits(cmd)
+	close(exited)
+	self.output.flush()
+	self.Lock()
+	if self.unhealthy {
+		err = fmt.Errorf("killed by health check: %s", self.healthError)
+	}
+	self.Unlock()
+	self.setExit(cmd, err)
+	return true, err, time.Since(t0)
+}
+
+// monitorHealth checks the daemon process until it exits, and kills it when it is unhealthy,
+// so that it is restarted by the supervisor
+func (self *Daemon) monitorHealth(pid int, exited chan struct{}) {
+	name := self.name
+	t0 := time.Now()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(self.health.interval):
+		}
+		err := self.health.check()
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		self.Lock()
+		if err == nil {
+			if self.healthState != HealthHealthy {
+				logger.Printf("INFO (_) [daemon] %s is healthy", name)
+			}
+			self.healthState, self.healthFailures, self.healthError = HealthHealthy, 0, ""
+			self.Unlock()
+			continue
+		}
+		self.healthError = err.Error()
+		if self.healthState == HealthUnknown && time.Since(t0) < self.health.grace {
+			// failures are not counted before the daemon is ready
+			self.Unlock()
+			continue
+		}
+		self.healthState = HealthUnhealthy
+		self.healthFailures++
+		failures := self.healthFailures
+		kill := failures >= self.health.threshold && !self.stopping
+		self.unhealthy = kill
+		self.Unlock()
+		logger.Printf("WARN (_) [daemon] %s health check failed (%d/%d): %s", name, failures, self.health.threshold, err.Error())
+		if !kill {
+			continue
+		}
+		logger.Printf("WARN (_) [daemon] %s is unhealthy, killing it. pid: %d", name, pid)
+		syscall.Kill(-pid, self.stopSignal)
+		select {
+		case <-exited:
+		case <-time.After(self.stopTimeout):
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+		return
+	}
+}
+
+func (self *Daemon) setExit(cmd *exec.Cmd, err error) {
+	exit := &daemonExit{Time: time.Now()}
+	if cmd != nil && cmd.ProcessState != nil {
+		result := newCmdResult(cmd.ProcessState, 0)
+		exit.ExitCode, exit.Signal = result.ExitCode, result.Signal
+	}
+	if err != nil {
+		exit.Error = err.Error()
+	}
+	self.Lock()
+	self.pid = 0
+	self.lastExit = exit
+	self.Unlock()
+}
+
+func (self *Daemon) Status() daemonStatus {
+	self.Lock()
+	defer self.Unlock()
+	ret := daemonStatus{
+		Name:     self.name,
+		State:    self.state,
+		Pid:      self.pid,
+		Since:    self.since,
+		Restarts: self.restarts,
+	}
+	if self.state == DaemonRunning {
+		ret.Uptime = time.Since(self.since).Seconds()
+		if self.health != nil {
+			ret.Health, ret.HealthFailures, ret.HealthError = self.healthState, self.healthFailures, self.healthError
+		}
+	}
+	if self.lastExit != nil {
+		lastExit := *self.lastExit
+		ret.LastExit = &lastExit
+	}
+	return ret
+}
+
+type DaemonServer struct {
+	*Session
+}
+
+func NewDaemonServer(sess *Session) Handler {
+	return DaemonServer{
+		Session: sess,
+	}
+}
+
+// /daemons, /daemons/<name>/status|output|stderr, POST /daemons/<name>/start|stop|restart
+func (self DaemonServer) serve() {
+	method := self.req.Method
+	if self.group == "" {
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		list := daemons.list()
+		ret := make([]daemonStatus, 0, len(list))
+		for _, daemon := range list {
+			ret = append(ret, daemon.Status())
+		}
+		self.JsonEnd(ret)
+		return
+	}
+	daemon := daemons.get(self.group)
+	if daemon == nil {
+		self.ErrorEnd(http.StatusNotFound, "daemon %s not found", self.group)
+		return
+	}
+	if self.tail != "" {
+		self.ErrorEnd(http.StatusNotFound, "bad daemon path: %s", self.req.URL.Path)
+		return
+	}
+	var action func() error
+	switch self.item {
+	case "status":
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		self.JsonEnd(daemon.Status())
+		return
+	case "output", "stderr":
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		if self.item == "output" {
+			self.serveLastLines(daemon.output.stdoutTail)
+		} else {
+			self.serveLastLines(daemon.output.stderrTail)
+		}
+		return
+	case "start":
+		action = daemon.Start
+	case "stop":
+		action = daemon.Stop
+	case "restart":
+		action = daemon.Restart
+	default:
+		self.ErrorEnd(http.StatusNotFound, "bad daemon path: %s", self.req.URL.Path)
+		return
+	}
+	if method != "POST" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+		return
+	}
+	// stopping may take the stop timeout, and a second more to kill
+	self.extendDeadline(daemon.stopTimeout + time.Second)
+	if err := action(); err != nil {
+		self.ErrorEnd(http.StatusConflict, "%s daemon %s failed: %s", self.item, self.group, err)
+		return
+	}
+	self.info("daemon %s %s by %s", self.group, self.item, self.username)
+	self.JsonEnd(daemon.Status())
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestDaemon(t *testing.T, name string, daemonConf *conf.Daemon) *Daemon {
+	daemonConf.Lang = "bash"
+	if daemonConf.Live == 0 {
+		daemonConf.Live = 3600
+	}
+	daemon, err := NewDaemon(name, daemonConf)
+	if err != nil {
+		t.Fatalf("create daemon failed: %s", err)
+	}
+	return daemon
+}
+
+func waitDaemonState(t *testing.T, daemon *Daemon, state string) daemonStatus {
+	var status daemonStatus
+	for i := 0; i < 500; i++ {
+		status = daemon.Status()
+		if status.State == state && (state != DaemonRunning || status.Pid > 0) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("daemon state should be %s, got %+v", state, status)
+	return status
+}
+
+func TestDaemonStartStop(t *testing.T) {
+	daemon := newTestDaemon(t, "d", &conf.Daemon{Code: "sleep 10"})
+	if err := daemon.Stop(); err == nil {
+		t.Error("stop a daemon not started should fail")
+	}
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("start daemon failed: %s", err)
+	}
+	if err := daemon.Start(); err == nil {
+		t.Error("start a started daemon should fail")
+	}
+	status := waitDaemonState(t, daemon, DaemonRunning)
+	if status.Restarts != 0 || status.LastExit != nil {
+		t.Errorf("bad status: %+v", status)
+	}
+	pid := status.Pid
+	if err := daemon.Restart(); err != nil {
+		t.Fatalf("restart daemon failed: %s", err)
+	}
+	status = waitDaemonState(t, daemon, DaemonRunning)
+	if status.Pid == pid {
+		t.Errorf("pid should change after restart: %+v", status)
+	}
+	if err := daemon.Stop(); err != nil {
+		t.Fatalf("stop daemon failed: %s", err)
+	}
+	status = daemon.Status()
+	if status.State != DaemonStopped || status.Pid != 0 || status.LastExit == nil || status.LastExit.Signal != int(syscall.SIGTERM) {
+		t.Errorf("bad status after stop: %+v", status)
+	}
+}
+
+func TestDaemonRetries(t *testing.T) {
+	daemon := newTestDaemon(t, "d", &conf.Daemon{Code: "exit 3", Retries: 2, Backoff: 1, MaxBackoff: 1})
+	daemon.Start()
+	waitDaemonState(t, daemon, DaemonBackoff)
+	status := waitDaemonState(t, daemon, DaemonFailed)
+	if status.Restarts != 2 || status.LastExit == nil || status.LastExit.ExitCode != 3 {
+		t.Errorf("bad status: %+v", status)
+	}
+	// can be started again after failed
+	if err := daemon.Start(); err != nil {
+		t.Errorf("start failed daemon failed: %s", err)
+	}
+	waitDaemonState(t, daemon, DaemonFailed)
+
+	daemon = newTestDaemon(t, "d", &conf.Daemon{Code: "true", Retries: 2})
+	daemon.Start()
+	status = waitDaemonState(t, daemon, DaemonStopped)
+	if status.Restarts != 0 || status.LastExit == nil || status.LastExit.ExitCode != 0 {
+		t.Errorf("normal exit should not be restarted: %+v", status)
+	}
+}
+
+func TestNewDaemonError(t *testing.T) {
+	if _, err := NewDaemon("d", &conf.Daemon{Restart: "sometimes"}); err == nil {
+		t.Error("bad restart policy should fail")
+	}
+	if _, err := NewDaemon("d", &conf.Daemon{StopSignal: "FOO"}); err == nil {
+		t.Error("bad stop signal should fail")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for s, sig := range map[string]syscall.Signal{
+		"TERM":    syscall.SIGTERM,
+		"SIGTERM": syscall.SIGTERM,
+		"int":     syscall.SIGINT,
+		"SIGQUIT": syscall.SIGQUIT,
+		"9":       syscall.SIGKILL,
+	} {
+		if ret, err := parseSignal(s); err != nil || ret != sig {
+			t.Errorf("%s should be %s, got %s %v", s, sig, ret, err)
+		}
+	}
+	for _, s := range []string{"", "FOO", "0", "100", "-1"} {
+		if _, err := parseSignal(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	delay := time.Second
+	for _, expected := range []time.Duration{2, 4, 8, 10, 10} {
+		delay = nextBackoff(delay, 10*time.Second)
+		if delay != expected*time.Second {
+			t.Errorf("delay should be %ds, got %s", expected, delay)
+		}
+	}
+}
+
+func TestDaemonRestartPolicy(t *testing.T) {
+	daemon := newTestDaemon(t, "d", &conf.Daemon{Code: "exit 3", Retries: 2, Restart: DaemonRestartNever})
+	daemon.Start()
+	status := waitDaemonState(t, daemon, DaemonFailed)
+	if status.Restarts != 0 {
+		t.Errorf("daemon should not be restarted: %+v", status)
+	}
+	// normal exits do not count as retries
+	daemon = newTestDaemon(t, "d", &conf.Daemon{Code: "true", Restart: DaemonRestartAlways})
+	daemon.Start()
+	for i := 0; i < 300 && daemon.Status().Restarts < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status = daemon.Status(); status.Restarts < 2 || status.State == DaemonStopped || status.State == DaemonFailed {
+		t.Errorf("daemon should be restarted: %+v", status)
+	}
+	daemon.Stop()
+	if status = daemon.Status(); status.State != DaemonStopped {
+		t.Errorf("daemon should be stopped: %+v", status)
+	}
+}
+
+func TestDaemonStopSignal(t *testing.T) {
+	daemon := newTestDaemon(t, "d", &conf.Daemon{Code: "trap 'exit 0' INT; sleep 10 & wait", StopSignal: "INT"})
+	daemon.Start()
+	waitDaemonState(t, daemon, DaemonRunning)
+	time.Sleep(100 * time.Millisecond) // wait for trap
+	daemon.Stop()
+	if status := daemon.Status(); status.LastExit == nil || status.LastExit.ExitCode != 0 || status.LastExit.Signal != 0 {
+		t.Errorf("daemon should exit by trap: %+v", status)
+	}
+
+	daemon = newTestDaemon(t, "d", &conf.Daemon{Code: "trap '' TERM; sleep 10 & wait", StopTimeout: 1})
+	daemon.Start()
+	waitDaemonState(t, daemon, DaemonRunning)
+	time.Sleep(100 * time.Millisecond)
+	t0 := time.Now()
+	daemon.Stop()
+	if d := time.Since(t0); d < time.Second || d > 3*time.Second {
+		t.Errorf("daemon should be killed after grace period, got %s", d)
+	}
+	if status := daemon.Status(); status.State != DaemonStopped || status.LastExit == nil || status.LastExit.Signal != int(syscall.SIGKILL) {
+		t.Errorf("daemon should be killed: %+v", status)
+	}
+}
+
+func TestServeDaemons(t *testing.T) {
+	daemon := newTestDaemon(t, "serve_test", &conf.Daemon{Code: "sleep 10"})
+	daemons.add(daemon)
+	serve := func(method, item string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/daemons/serve_test/"+item, nil)
+		resp := httptest.NewRecorder()
+		NewDaemonServer(&Session{req: req, resp: resp, resource: "daemons", group: "serve_test", item: item}).serve()
+		return resp
+	}
+	resp := serve("POST", "start")
+	var status daemonStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+		t.Fatalf("bad status: %s %s", err, resp.Body.String())
+	}
+	if status.Name != "serve_test" || status.State == DaemonStopped {
+		t.Errorf("daemon should be started: %+v", status)
+	}
+	if resp = serve("POST", "start"); resp.Code != http.StatusConflict {
+		t.Errorf("start twice should be 409, got %d", resp.Code)
+	}
+	if resp = serve("GET", "stop"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("stop should be POST only, got %d", resp.Code)
+	}
+	waitDaemonState(t, daemon, DaemonRunning)
+	resp = serve("GET", "status")
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil || status.State != DaemonRunning || status.Pid == 0 {
+		t.Errorf("bad status: %s", resp.Body.String())
+	}
+	resp = serve("POST", "stop")
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil || status.State != DaemonStopped {
+		t.Errorf("daemon should be stopped: %s", resp.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/daemons", nil)
+	resp = httptest.NewRecorder()
+	NewDaemonServer(&Session{req: req, resp: resp, resource: "daemons"}).serve()
+	var list []daemonStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil || len(list) == 0 {
+		t.Errorf("bad daemon list: %s", resp.Body.String())
+	}
+}
+
+func TestStartDaemons(t *testing.T) {
+	daemonConfs := map[string]*conf.Daemon{
+		"order_a": {Code: "sleep 10", Depends: []string{"order_b"}},
+		// ready in about 0.5s
+		"order_b": {Code: "sleep 10", Ready: conf.Ready{Health: conf.Health{Type: HealthCommand, Lang: "bash", Code: "sleep 0.5"}}},
+		"order_c": {Code: "sleep 10", Depends: []string{"order_d"}},
+		"order_d": {Code: "sleep 10", Ready: conf.Ready{Health: conf.Health{Type: HealthCommand, Lang: "bash", Code: "exit 1"}, Wait: 1}},
+	}
+	for _, daemonConf := range daemonConfs {
+		daemonConf.Lang = "bash"
+		daemonConf.Live = 3600
+	}
+	startDaemons(daemonConfs)
+	time.Sleep(200 * time.Millisecond)
+	if daemons.get("order_a") != nil {
+		t.Error("daemon should not start before its dependency is ready")
+	}
+	for i := 0; i < 300 && daemons.get("order_a") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a, b := daemons.get("order_a"), daemons.get("order_b")
+	if a == nil || b == nil {
+		t.Fatal("daemons should be started")
+	}
+	waitDaemonState(t, a, DaemonRunning)
+	time.Sleep(1500 * time.Millisecond)
+	if daemons.get("order_d") == nil || daemons.get("order_c") != nil {
+		t.Error("daemon should not start when its dependency is not ready")
+	}
+
+	stopDaemons()
+	aExit, bExit := a.Status().LastExit, b.Status().LastExit
+	if aExit == nil || bExit == nil || bExit.Time.Before(aExit.Time) {
+		t.Errorf("daemon should be stopped before its dependency: %+v %+v", aExit, bExit)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io"
+	"net/http"
+	"time"
+)
+
+const defaultReadTimeout = 10
+const defaultWriteTimeout = 10
+const defaultMaxHeaderBytes = 8192
+
+func newHttpServer(serverConf *conf.Server, handler http.Handler) *http.Server {
+	ret := &http.Server{
+		Addr:           serverConf.Listen,
+		Handler:        handler,
+		ReadTimeout:    readTimeout(serverConf),
+		WriteTimeout:   writeTimeout(serverConf),
+		IdleTimeout:    time.Duration(serverConf.IdleTimeout) * time.Second,
+		MaxHeaderBytes: serverConf.MaxHeaderBytes,
+	}
+	if ret.MaxHeaderBytes <= 0 {
+		ret.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	return ret
+}
+
+func readTimeout(serverConf *conf.Server) time.Duration {
+	if serverConf.ReadTimeout == 0 {
+		return defaultReadTimeout * time.Second
+	}
+	return time.Duration(serverConf.ReadTimeout) * time.Second
+}
+
+func writeTimeout(serverConf *conf.Server) time.Duration {
+	if serverConf.WriteTimeout == 0 {
+		return defaultWriteTimeout * time.Second
+	}
+	return time.Duration(serverConf.WriteTimeout) * time.Second
+}
+
+func (self *Session) writeTimeout() time.Duration {
+	if self.config == nil {
+		return defaultWriteTimeout * time.Second
+	}
+	return writeTimeout(&self.config.Server)
+}
+
+// extendDeadline allows the request to be read and the response to be written in d and the write timeout from now,
+// for requests which may take longer than the server timeouts
+func (self *Session) extendDeadline(d time.Duration) {
+	deadline := time.Now().Add(d + self.writeTimeout())
+	rc := http.NewResponseController(self.resp)
+	if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		self.warn("set read deadline failed: %s", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		self.warn("set write deadline failed: %s", err)
+	}
+}
+
+// data sent in a ReadFrom of deadlineWriter before the deadline is extended
+const deadlineWriterChunk = 1 << 20
+
+// deadlineWriter extends the write deadline on each write,
+// so that a long transfer is not cut off as long as it keeps going
+type deadlineWriter struct {
+	rc      *http.ResponseController
+	w       io.Writer
+	timeout time.Duration
+}
+
+func (self *Session) newDeadlineWriter() *deadlineWriter {
+	return &deadlineWriter{rc: http.NewResponseController(self.resp), w: self.resp, timeout: self.writeTimeout()}
+}
+
+func (self *deadlineWriter) Write(p []byte) (int, error) {
+	// not supported by all response writers, then the server timeout works
+	_ = self.rc.SetWriteDeadline(time.Now().Add(self.timeout))
+	return self.w.Write(p)
+}
+
+// ReadFrom lets io.Copy use ReadFrom of the response, which sends files by sendfile(2).
+// Data is sent in chunks, extending the deadline before each one.
+func (self *deadlineWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := self.w.(io.ReaderFrom)
+	if !ok {
+		// hides ReadFrom of self
+		return io.Copy(struct{ io.Writer }{self}, r)
+	}
+	// sendfile works only with a file, or a file directly in a LimitedReader
+	remain := int64(-1)
+	lr, limited := r.(*io.LimitedReader)
+	if limited {
+		r, remain = lr.R, lr.N
+	}
+	var total int64
+	for remain != 0 {
+		n := int64(deadlineWriterChunk)
+		if remain > 0 && remain < n {
+			n = remain
+		}
+		_ = self.rc.SetWriteDeadline(time.Now().Add(self.timeout))
+		written, err := rf.ReadFrom(&io.LimitedReader{R: r, N: n})
+		total += written
+		if limited {
+			remain -= written
+			lr.N = remain
+		}
+		if err != nil || written < n {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// deadlineReader extends the read deadline on each read of the request body,
+// and the write deadline too, as the response is written after the body is read
+type deadlineReader struct {
+	rc           *http.ResponseController
+	r            io.Reader
+	timeout      time.Duration
+	writeTimeout time.Duration
+}
+
+func (self *Session) newDeadlineReader() *deadlineReader {
+	timeout := defaultReadTimeout * time.Second
+	if self.config != nil {
+		timeout = readTimeout(&self.config.Server)
+	}
+	return &deadlineReader{
+		rc:           http.NewResponseController(self.resp),
+		r:            self.req.Body,
+		timeout:      timeout,
+		writeTimeout: self.writeTimeout(),
+	}
+}
+
+func (self *deadlineReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	_ = self.rc.SetReadDeadline(now.Add(self.timeout))
+	_ = self.rc.SetWriteDeadline(now.Add(self.writeTimeout))
+	return self.r.Read(p)
+}
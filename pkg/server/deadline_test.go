@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHttpServer(t *testing.T) {
+	s := newHttpServer(&conf.Server{Listen: ":2465"}, nil)
+	if s.Addr != ":2465" || s.ReadTimeout != 10*time.Second || s.WriteTimeout != 10*time.Second || s.IdleTimeout != 0 || s.MaxHeaderBytes != 8192 {
+		t.Errorf("bad defaults: %+v", s)
+	}
+	s = newHttpServer(&conf.Server{ReadTimeout: 1, WriteTimeout: 2, IdleTimeout: 3, MaxHeaderBytes: 1024}, nil)
+	if s.ReadTimeout != time.Second || s.WriteTimeout != 2*time.Second || s.IdleTimeout != 3*time.Second || s.MaxHeaderBytes != 1024 {
+		t.Errorf("bad server: %+v", s)
+	}
+}
+
+func TestExtendDeadline(t *testing.T) {
+	config := &conf.Config{Server: conf.Server{ReadTimeout: 1, WriteTimeout: 1}}
+	s := newHttpServer(&config.Server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := &Session{config: config, req: r, resp: w}
+		if r.URL.Path == "/extend" {
+			sess.extendDeadline(time.Second)
+		}
+		if r.URL.Path == "/upload" {
+			data, err := ioutil.ReadAll(sess.newDeadlineReader())
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		time.Sleep(1500 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	defer s.Close()
+	url := "http://" + listener.Addr().String()
+	if resp, err := http.Get(url + "/extend"); err != nil {
+		t.Errorf("extended request should succeed: %s", err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "done" {
+			t.Errorf("bad response: %q", body)
+		}
+	}
+	if resp, err := http.Get(url + "/"); err == nil {
+		resp.Body.Close()
+		t.Error("request should be cut off by the write timeout")
+	}
+
+	// a slow upload goes on as long as it keeps sending
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			writer.Write([]byte("hello"))
+			time.Sleep(600 * time.Millisecond)
+		}
+		writer.Close()
+	}()
+	resp, err := http.Post(url+"/upload", "text/plain", reader)
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != strings.Repeat("hello", 3) {
+		t.Errorf("bad upload: %d %q", resp.StatusCode, body)
+	}
+}
+
+// readerFromWriter records what ReadFrom is called with
+type readerFromWriter struct {
+	bytes.Buffer
+	chunks  []int64
+	notFile bool
+}
+
+func (self *readerFromWriter) ReadFrom(r io.Reader) (int64, error) {
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		self.notFile = true
+		return self.Buffer.ReadFrom(r)
+	}
+	if _, ok = lr.R.(*os.File); !ok {
+		self.notFile = true
+	}
+	self.chunks = append(self.chunks, lr.N)
+	return self.Buffer.ReadFrom(r)
+}
+
+func TestDeadlineWriterReadFrom(t *testing.T) {
+	file, err := ioutil.TempFile("", "servant_deadline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	data := bytes.Repeat([]byte("0123456789"), deadlineWriterChunk/4)
+	file.Write(data)
+	file.Seek(0, io.SeekStart)
+	w := &readerFromWriter{}
+	dw := &deadlineWriter{rc: http.NewResponseController(httptest.NewRecorder()), w: w, timeout: time.Second}
+	n, err := io.CopyN(dw, file, int64(len(data)-10))
+	if err != nil || n != int64(len(data)-10) || !bytes.Equal(w.Bytes(), data[:len(data)-10]) {
+		t.Errorf("copy wrong: %d %v", n, err)
+	}
+	expected := []int64{deadlineWriterChunk, deadlineWriterChunk, int64(len(data)-10) - 2*deadlineWriterChunk}
+	if w.notFile || !reflect.DeepEqual(w.chunks, expected) {
+		t.Errorf("file should be sent in chunks: %v %v", w.notFile, w.chunks)
+	}
+}
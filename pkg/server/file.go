@@ -98,7 +98,7 @@ func (self FileServer) serveGet(filePath string) {
 		}
 		self.resp.Header().Set("Content-Range", ranges[0].contentRange(info.Size()))
 	}
-	_, err = io.CopyN(self.resp, file, length)
+	_, err = io.CopyN(self.newDeadlineWriter(), file, length)
 	if err != nil {
 		self.BadEnd("io error: %s", err)
 	} else {
@@ -132,7 +132,7 @@ func (self FileServer) servePost(filePath string) {
 		return
 	}
 	defer file.Close()
-	_, err = io.Copy(file, self.req.Body)
+	_, err = io.Copy(file, self.newDeadlineReader())
 	if err != nil {
 		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
 	} else {
@@ -147,7 +147,7 @@ func (self FileServer) servePut(filePath string) {
 		return
 	}
 	defer file.Close()
-	_, err = io.Copy(file, self.req.Body)
+	_, err = io.Copy(file, self.newDeadlineReader())
 	if err != nil {
 		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
 	} else {
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const flockPollInterval = 100 * time.Millisecond
+
+// FileLock is a lock by flock(2) on a file, so it can be shared with other processes.
+// Each acquiring opens the file, so holders in the same process also exclude each other.
+type FileLock struct {
+	path string
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// open opens the lock file, not following symlinks, so lock files can not be used to create other files
+func (self *FileLock) open() (*os.File, error) {
+	return os.OpenFile(self.path, os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0644)
+}
+
+// lock blocks when block is set, otherwise tries until d passed. Returns nil without error
+// when the lock is held by others.
+func (self *FileLock) lock(how int, block bool, d time.Duration) (*os.File, error) {
+	file, err := self.open()
+	if err != nil {
+		return nil, fmt.Errorf("open lock file %s failed: %s", self.path, err)
+	}
+	if block {
+		if err := syscall.Flock(int(file.Fd()), how); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("flock %s failed: %s", self.path, err)
+		}
+		return file, nil
+	}
+	deadline := time.Now().Add(d)
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("flock %s failed: %s", self.path, err)
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(flockPollInterval)
+	}
+	file.Close()
+	return nil, nil
+}
+
+// logged logs the error of lock, for methods of Lock which can only tell whether the lock is acquired
+func (self *FileLock) logged(file *os.File, err error) *os.File {
+	if err != nil {
+		logger.Printf("WARN (_) [lock] %s", err)
+	}
+	return file
+}
+
+func (self *FileLock) unlock(file *os.File) {
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
+
+func (self *FileLock) with(file *os.File, f func()) bool {
+	if file == nil {
+		return false
+	}
+	defer self.unlock(file)
+	f()
+	return true
+}
+
+func (self *FileLock) With(f func()) {
+	self.with(self.logged(self.lock(syscall.LOCK_EX, true, 0)), f)
+}
+
+func (self *FileLock) TryWith(f func()) bool {
+	return self.with(self.logged(self.lock(syscall.LOCK_EX, false, 0)), f)
+}
+
+func (self *FileLock) TimeoutWith(d time.Duration, f func()) bool {
+	return self.with(self.logged(self.lock(syscall.LOCK_EX, false, d)), f)
+}
+
+func (self *FileLock) SharedWith(f func()) {
+	self.with(self.logged(self.lock(syscall.LOCK_SH, true, 0)), f)
+}
+
+func (self *FileLock) TrySharedWith(f func()) bool {
+	return self.with(self.logged(self.lock(syscall.LOCK_SH, false, 0)), f)
+}
+
+func (self *FileLock) TimeoutSharedWith(d time.Duration, f func()) bool {
+	return self.with(self.logged(self.lock(syscall.LOCK_SH, false, d)), f)
+}
+
+// tryWith runs f holding the lock, trying until d passed. Returns an error when the lock file
+// can not be opened or locked, instead of false as held by others.
+func (self *FileLock) tryWith(shared bool, d time.Duration, f func()) (bool, error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	file, err := self.lock(how, false, d)
+	if err != nil {
+		return false, err
+	}
+	return self.with(file, f), nil
+}
+
+// lockFileDir is the directory the lock file path must stay in after vars expanded,
+// which is the directory of the path before the first var
+func lockFileDir(file string) string {
+	i := strings.Index(file, "${")
+	if i < 0 {
+		return filepath.Dir(file)
+	}
+	return filepath.Dir(file[:i])
+}
+
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// expandLockConf expands vars in the lock file path. Values of vars can not be "..", or contain "/",
+// and the path expanded must stay in the directory before the first var, resolving symlinks.
+func expandLockConf(lockConf conf.Lock, params ParamFunc) (conf.Lock, error) {
+	if lockConf.File == "" || !strings.Contains(lockConf.File, "${") {
+		return lockConf, nil
+	}
+	badValue := ""
+	file, exists := replaceCmdParams(lockConf.File, func(k string) (string, bool) {
+		v, ok := params(k)
+		if ok && (v == "." || v == ".." || strings.Contains(v, "/")) && badValue == "" {
+			badValue = v
+		}
+		return v, ok
+	})
+	if !exists {
+		return lockConf, fmt.Errorf("some params missing in lock file")
+	}
+	if badValue != "" {
+		return lockConf, fmt.Errorf("bad param in lock file: %s", badValue)
+	}
+	dir := lockFileDir(lockConf.File)
+	file = filepath.Clean(file)
+	if !isInDir(file, dir) {
+		return lockConf, fmt.Errorf("lock file %s is out of %s", file, dir)
+	}
+	// dirs of the path may be symlinks to elsewhere
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(file)); err == nil {
+		resolvedDir, err := filepath.EvalSymlinks(dir)
+		if err != nil || (resolved != resolvedDir && !isInDir(resolved, resolvedDir)) {
+			return lockConf, fmt.Errorf("lock file %s is out of %s", file, dir)
+		}
+	}
+	lockConf.File = file
+	return lockConf, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+	lock1 := NewFileLock(path)
+	lock2 := NewFileLock(path)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go lock1.With(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	if lock2.TryWith(func() {}) {
+		t.Error("try should fail")
+	}
+	if lock2.TrySharedWith(func() {}) {
+		t.Error("try shared should fail")
+	}
+	t0 := time.Now()
+	if lock2.TimeoutWith(200*time.Millisecond, func() {}) {
+		t.Error("wait should timeout")
+	}
+	if time.Since(t0) < 200*time.Millisecond {
+		t.Error("should wait until timeout")
+	}
+	close(release)
+	if !lock2.TimeoutWith(time.Second, func() {}) {
+		t.Error("wait should be ok after released")
+	}
+
+	sharedStarted := make(chan struct{})
+	sharedRelease := make(chan struct{})
+	go lock1.SharedWith(func() {
+		close(sharedStarted)
+		<-sharedRelease
+	})
+	<-sharedStarted
+	if !lock2.TrySharedWith(func() {}) {
+		t.Error("try shared should be ok")
+	}
+	if lock2.TryWith(func() {}) {
+		t.Error("try should fail")
+	}
+	close(sharedRelease)
+
+	if NewFileLock(filepath.Join(dir, "no_such_dir", "test.lock")).TryWith(func() {}) {
+		t.Error("bad lock file should fail")
+	}
+	lockConf := conf.Lock{Name: "bad", File: filepath.Join(dir, "no_such_dir", "test.lock")}
+	if locked, err := withConfLock(&lockConf, LockOwner{}, func() {}); locked || err == nil {
+		t.Error("bad lock file should be an error")
+	}
+	lockConf = conf.Lock{Name: "good", File: path, Wait: true, Timeout: 1}
+	if locked, err := withConfLock(&lockConf, LockOwner{}, func() {}); !locked || err != nil {
+		t.Errorf("lock file should be ok: %v", err)
+	}
+	lockMapMutex.Lock()
+	_, ok := locks["good:"+path]
+	lockMapMutex.Unlock()
+	if ok {
+		t.Error("idle file lock should be removed")
+	}
+}
+
+func TestExpandLockConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Symlink("/", filepath.Join(dir, "root")); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"db": "db1", "dot": ".", "up": "..", "abs": "/etc/passwd", "root": "root"}
+	params := func(k string) (string, bool) {
+		v, ok := values[k]
+		return v, ok
+	}
+	lockConf, err := expandLockConf(conf.Lock{Name: "l", File: "/var/lock/${db}.lock"}, params)
+	if err != nil || lockConf.File != "/var/lock/db1.lock" {
+		t.Errorf("expand wrong: %s %v", lockConf.File, err)
+	}
+	if _, err = expandLockConf(conf.Lock{Name: "l", File: "/var/lock/${x}.lock"}, params); err == nil {
+		t.Error("missing param should fail")
+	}
+	for _, file := range []string{"/var/lock/${up}", "/var/lock/${dot}${dot}/passwd", "/var/lock/${abs}",
+		"${abs}", filepath.Join(dir, "${root}", "etc", "x.lock")} {
+		if lockConf, err := expandLockConf(conf.Lock{Name: "l", File: file}, params); err == nil {
+			t.Errorf("lock file out of dir should fail: %s -> %s", file, lockConf.File)
+		}
+	}
+	lockConf, _ = expandLockConf(conf.Lock{Name: "l", File: "/var/lock/${db}.lock"}, params)
+	l := GetConfLock(&lockConf)
+	defer releaseLock(l)
+	if l.kind != "file" || l.name != "l:/var/lock/db1.lock" {
+		t.Errorf("should be file lock: %s %s", l.kind, l.name)
+	}
+}
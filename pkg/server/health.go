@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	HealthHttp    = "http"
+	HealthTcp     = "tcp"
+	HealthCommand = "command"
+)
+
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+const defaultHealthInterval = 10
+const defaultHealthTimeout = 5
+const defaultHealthThreshold = 3
+
+// healthCheck checks whether a running daemon works
+type healthCheck struct {
+	typ       string
+	url       string
+	address   string
+	cmdConf   conf.Command
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	grace     time.Duration
+}
+
+// newHealthCheck returns nil if no health check is configured
+func newHealthCheck(healthConf *conf.Health, daemonConf *conf.Daemon) (*healthCheck, error) {
+	ret := &healthCheck{typ: healthConf.Type}
+	switch healthConf.Type {
+	case "":
+		return nil, nil
+	case HealthHttp:
+		if !strings.HasPrefix(healthConf.Url, "http://") && !strings.HasPrefix(healthConf.Url, "https://") {
+			return nil, fmt.Errorf("bad health check url: %s", healthConf.Url)
+		}
+		ret.url = healthConf.Url
+	case HealthTcp:
+		if _, _, err := net.SplitHostPort(healthConf.Address); err != nil {
+			return nil, fmt.Errorf("bad health check address: %s", healthConf.Address)
+		}
+		ret.address = healthConf.Address
+	case HealthCommand:
+		if strings.TrimSpace(healthConf.Code) == "" {
+			return nil, fmt.Errorf("health check code is empty")
+		}
+		ret.cmdConf = conf.Command{
+			Lang:       healthConf.Lang,
+			Code:       healthConf.Code,
+			User:       daemonConf.User,
+			Background: true,
+			Env:        daemonConf.Env,
+			Workdir:    daemonConf.Workdir,
+			CleanEnv:   daemonConf.CleanEnv,
+		}
+	default:
+		return nil, fmt.Errorf("unknown health check type: %s", healthConf.Type)
+	}
+	interval, timeout, threshold := healthConf.Interval, healthConf.Timeout, healthConf.Threshold
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	if threshold <= 0 {
+		threshold = defaultHealthThreshold
+	}
+	ret.interval = time.Duration(interval) * time.Second
+	ret.timeout = time.Duration(timeout) * time.Second
+	ret.threshold = threshold
+	ret.grace = time.Duration(healthConf.Grace) * time.Second
+	return ret, nil
+}
+
+func (self *healthCheck) check() error {
+	switch self.typ {
+	case HealthHttp:
+		return self.checkHttp()
+	case HealthTcp:
+		return self.checkTcp()
+	default:
+		return self.checkCommand()
+	}
+}
+
+func (self *healthCheck) checkHttp() error {
+	client := http.Client{Timeout: self.timeout}
+	resp, err := client.Get(self.url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (self *healthCheck) checkTcp() error {
+	conn, err := net.DialTimeout("tcp", self.address, self.timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func (self *healthCheck) checkCommand() error {
+	cmd, out, err := cmdFromConf(&self.cmdConf, requestParams(nil), nil)
+	if out != nil {
+		out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	output := newLimitedBuffer(maxLoggedOutput)
+	cmd.Stdout, cmd.Stderr = output, output
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	deadline := time.AfterFunc(self.timeout, func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	if !deadline.Stop() {
+		return fmt.Errorf("timeout after %s", self.timeout)
+	}
+	if err != nil {
+		if output.Len() > 0 {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHealthCheck(t *testing.T) {
+	if health, err := newHealthCheck(&conf.Health{}, &conf.Daemon{}); health != nil || err != nil {
+		t.Errorf("no health check should be nil: %v %v", health, err)
+	}
+	health, err := newHealthCheck(&conf.Health{Type: HealthTcp, Address: "127.0.0.1:80"}, &conf.Daemon{})
+	if err != nil {
+		t.Fatalf("create health check failed: %s", err)
+	}
+	if health.interval != defaultHealthInterval*time.Second || health.timeout != defaultHealthTimeout*time.Second || health.threshold != defaultHealthThreshold {
+		t.Errorf("bad defaults: %+v", health)
+	}
+	for _, healthConf := range []conf.Health{
+		{Type: "udp"},
+		{Type: HealthHttp, Url: "127.0.0.1"},
+		{Type: HealthTcp, Address: "127.0.0.1"},
+		{Type: HealthCommand},
+	} {
+		if _, err := newHealthCheck(&healthConf, &conf.Daemon{}); err == nil {
+			t.Errorf("%+v should be invalid", healthConf)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	for _, c := range []struct {
+		conf conf.Health
+		ok   bool
+	}{
+		{conf.Health{Type: HealthHttp, Url: server.URL + "/ok"}, true},
+		{conf.Health{Type: HealthHttp, Url: server.URL + "/bad"}, false},
+		{conf.Health{Type: HealthTcp, Address: server.Listener.Addr().String()}, true},
+		{conf.Health{Type: HealthTcp, Address: addr}, false},
+		{conf.Health{Type: HealthCommand, Lang: "bash", Code: "true"}, true},
+		{conf.Health{Type: HealthCommand, Lang: "bash", Code: "echo bad; exit 1"}, false},
+		{conf.Health{Type: HealthCommand, Lang: "bash", Code: "sleep 10", Timeout: 1}, false},
+	} {
+		health, err := newHealthCheck(&c.conf, &conf.Daemon{})
+		if err != nil {
+			t.Errorf("create health check failed: %s", err)
+			continue
+		}
+		if err = health.check(); (err == nil) != c.ok {
+			t.Errorf("%+v should be %v, got %v", c.conf, c.ok, err)
+		}
+	}
+}
+
+func TestDaemonHealth(t *testing.T) {
+	daemon := newTestDaemon(t, "d", &conf.Daemon{Code: "sleep 10", Health: conf.Health{Type: HealthCommand, Lang: "bash", Code: "true"}})
+	daemon.health.interval = 50 * time.Millisecond
+	daemon.Start()
+	for i := 0; i < 100 && daemon.Status().Health != HealthHealthy; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := daemon.Status(); status.Health != HealthHealthy || status.State != DaemonRunning {
+		t.Errorf("daemon should be healthy: %+v", status)
+	}
+	daemon.Stop()
+	if status := daemon.Status(); status.Health != "" {
+		t.Errorf("stopped daemon should have no health: %+v", status)
+	}
+
+	daemon = newTestDaemon(t, "d", &conf.Daemon{Code: "sleep 10", Retries: 1, Backoff: 1,
+		Health: conf.Health{Type: HealthCommand, Lang: "bash", Code: "echo down; exit 1", Threshold: 2}})
+	daemon.health.interval = 50 * time.Millisecond
+	daemon.Start()
+	status := waitDaemonState(t, daemon, DaemonBackoff)
+	if status.Restarts != 0 || status.LastExit == nil || !strings.Contains(status.LastExit.Error, "down") {
+		t.Errorf("unhealthy daemon should be killed: %+v", status)
+	}
+	status = waitDaemonState(t, daemon, DaemonRunning)
+	if status.Restarts != 1 || status.Health == HealthHealthy || status.Health == "" {
+		t.Errorf("unhealthy daemon should be restarted: %+v", status)
+	}
+	daemon.Stop()
+}
@@ -0,0 +1,458 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ServantJobIdHeader = "X-Servant-Job-Id"
+const ServantJobStateHeader = "X-Servant-Job-State"
+const ServantOutputOffsetHeader = "X-Servant-Output-Offset"
+const ServantOutputNextHeader = "X-Servant-Output-Next"
+
+const (
+	JobRunning = "running"
+	JobExited  = "exited"
+	JobKilled  = "killed"
+)
+
+const defaultMaxJobs = 100
+const defaultJobRetention = 3600
+const defaultJobOutputSize = 1024 * 1024
+
+// how long DELETE waits for a killed job to exit
+var jobKillWait = 5 * time.Second
+
+// outputBuffer keeps the last max bytes written, and remembers the offset
+// of the first kept byte in the whole output, so that clients can tail it.
+// Once full, it is a ring and new bytes overwrite the oldest ones from head.
+type outputBuffer struct {
+	sync.Mutex
+	data  []byte
+	head  int
+	start int64
+	max   int
+}
+
+func newOutputBuffer(max int) *outputBuffer {
+	return &outputBuffer{max: max, data: make([]byte, 0, 1024)}
+}
+
+func (self *outputBuffer) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	n := len(p)
+	if n > self.max {
+		// only the last max bytes are kept
+		self.start += int64(len(self.data) + n - self.max)
+		self.data = append(self.data[:0], p[n-self.max:]...)
+		self.head = 0
+		return n, nil
+	}
+	if room := self.max - len(self.data); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		self.data = append(self.data, p[:room]...)
+		p = p[room:]
+	}
+	for len(p) > 0 {
+		c := copy(self.data[self.head:], p)
+		p = p[c:]
+		self.start += int64(c)
+		self.head = (self.head + c) % self.max
+	}
+	return n, nil
+}
+
+// Since returns data from offset, and the offsets of returned data and of the end of output.
+// A negative offset counts from the end of output.
+func (self *outputBuffer) Since(offset int64) (data []byte, start int64, next int64) {
+	self.Lock()
+	defer self.Unlock()
+	next = self.start + int64(len(self.data))
+	if offset < 0 {
+		offset += next
+	}
+	if offset < self.start {
+		offset = self.start
+	}
+	if offset > next {
+		offset = next
+	}
+	data = make([]byte, next-offset)
+	if len(data) == 0 {
+		return data, offset, next
+	}
+	i := self.head + int(offset-self.start)
+	if i >= len(self.data) {
+		copy(data, self.data[i-len(self.data):self.head])
+	} else {
+		c := copy(data, self.data[i:])
+		copy(data[c:], self.data[:self.head])
+	}
+	return data, offset, next
+}
+
+func (self *outputBuffer) Size() int64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.start + int64(len(self.data))
+}
+
+type Job struct {
+	sync.Mutex
+	Id        uint64
+	Group     string
+	Command   string
+	Username  string
+	Session   uint64
+	Args      []string
+	Pid       int
+	StartTime time.Time
+	EndTime   time.Time
+	State     string
+	ExitCode  int
+	Signal    int
+	stdout    *outputBuffer
+	stderr    *outputBuffer
+	done      chan struct{}
+}
+
+type jobStatus struct {
+	Id         uint64     `json:"id"`
+	Group      string     `json:"group"`
+	Command    string     `json:"command"`
+	User       string     `json:"user,omitempty"`
+	Args       []string   `json:"args"`
+	Pid        int        `json:"pid"`
+	State      string     `json:"state"`
+	ExitCode   int        `json:"exit_code"`
+	Signal     int        `json:"signal,omitempty"`
+	Start      time.Time  `json:"start"`
+	End        *time.Time `json:"end,omitempty"`
+	Duration   float64    `json:"duration"`
+	OutputSize int64      `json:"output_size"`
+	StderrSize int64      `json:"stderr_size"`
+}
+
+func (self *Job) start(cmd *exec.Cmd, timeout time.Duration, onExit func(*Job, error)) {
+	self.Lock()
+	self.Args = cmd.Args
+	self.Pid = cmd.Process.Pid
+	self.StartTime = time.Now()
+	self.State = JobRunning
+	self.Unlock()
+	registerProcess(cmd)
+	go func() {
+		timer := time.AfterFunc(timeout, func() {
+			self.Kill()
+		})
+		err := cmd.Wait()
+		unregisterProcess(cmd)
+		releaseLimits(cmd)
+		timer.Stop()
+		self.Lock()
+		self.EndTime = time.Now()
+		self.State = JobExited
+		if cmd.ProcessState != nil {
+			result := newCmdResult(cmd.ProcessState, 0)
+			self.ExitCode, self.Signal = result.ExitCode, result.Signal
+			if result.Signal != 0 {
+				self.State = JobKilled
+			}
+		}
+		self.Unlock()
+		close(self.done)
+		onExit(self, err)
+	}()
+}
+
+// Kill kills the whole process group of the job.
+func (self *Job) Kill() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.State != JobRunning {
+		return fmt.Errorf("job %d is not running", self.Id)
+	}
+	return syscall.Kill(-self.Pid, syscall.SIGKILL)
+}
+
+func (self *Job) Status() jobStatus {
+	self.Lock()
+	defer self.Unlock()
+	ret := jobStatus{
+		Id:         self.Id,
+		Group:      self.Group,
+		Command:    self.Command,
+		User:       self.Username,
+		Args:       self.Args,
+		Pid:        self.Pid,
+		State:      self.State,
+		ExitCode:   self.ExitCode,
+		Signal:     self.Signal,
+		Start:      self.StartTime,
+		OutputSize: self.stdout.Size(),
+		StderrSize: self.stderr.Size(),
+	}
+	if self.State == JobRunning {
+		ret.Duration = time.Since(self.StartTime).Seconds()
+	} else {
+		end := self.EndTime
+		ret.End = &end
+		ret.Duration = self.EndTime.Sub(self.StartTime).Seconds()
+	}
+	return ret
+}
+
+type jobTable struct {
+	sync.Mutex
+	jobs      map[uint64]*Job
+	nextId    uint64
+	max       int
+	retention time.Duration
+	output    int
+}
+
+var jobs = newJobTable(conf.Jobs{})
+
+func newJobTable(jobsConf conf.Jobs) *jobTable {
+	ret := &jobTable{jobs: make(map[uint64]*Job)}
+	ret.configure(jobsConf)
+	return ret
+}
+
+func (self *jobTable) configure(jobsConf conf.Jobs) {
+	self.Lock()
+	defer self.Unlock()
+	self.max = jobsConf.Max
+	if self.max <= 0 {
+		self.max = defaultMaxJobs
+	}
+	self.retention = time.Duration(jobsConf.Retention) * time.Second
+	if self.retention <= 0 {
+		self.retention = defaultJobRetention * time.Second
+	}
+	self.output = jobsConf.Output
+	if self.output <= 0 {
+		self.output = defaultJobOutputSize
+	}
+}
+
+func (self *jobTable) newJob(sess *Session) (*Job, error) {
+	self.Lock()
+	defer self.Unlock()
+	self.prune(time.Now())
+	if len(self.jobs) >= self.max {
+		return nil, NewServantError(http.StatusServiceUnavailable, "too many jobs: %d", len(self.jobs))
+	}
+	self.nextId++
+	job := &Job{
+		Id:       self.nextId,
+		Group:    sess.group,
+		Command:  sess.item,
+		Username: sess.username,
+		Session:  sess.id,
+		stdout:   newOutputBuffer(self.output),
+		stderr:   newOutputBuffer(self.output),
+		done:     make(chan struct{}),
+	}
+	self.jobs[job.Id] = job
+	return job, nil
+}
+
+// prune removes finished jobs out of retention, and the oldest finished ones when the table is full.
+// Must be called with lock held.
+func (self *jobTable) prune(now time.Time) {
+	finished := make([]*Job, 0, len(self.jobs))
+	for id, job := range self.jobs {
+		job.Lock()
+		if job.State != JobRunning && job.State != "" {
+			if now.Sub(job.EndTime) > self.retention {
+				delete(self.jobs, id)
+			} else {
+				finished = append(finished, job)
+			}
+		}
+		job.Unlock()
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Id < finished[j].Id })
+	for i := 0; len(self.jobs) >= self.max && i < len(finished); i++ {
+		delete(self.jobs, finished[i].Id)
+	}
+}
+
+func (self *jobTable) get(id uint64) *Job {
+	self.Lock()
+	defer self.Unlock()
+	return self.jobs[id]
+}
+
+func (self *jobTable) remove(id uint64) {
+	self.Lock()
+	delete(self.jobs, id)
+	self.Unlock()
+}
+
+func (self *jobTable) list(group, command string) []*Job {
+	self.Lock()
+	defer self.Unlock()
+	self.prune(time.Now())
+	ret := make([]*Job, 0, len(self.jobs))
+	for _, job := range self.jobs {
+		if job.Group == group && job.Command == command {
+			ret = append(ret, job)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret
+}
+
+func (self CommandServer) serveJob(cmdConf *conf.Command) {
+	cmd, _, err := self.newCmd(cmdConf)
+	if err != nil {
+		self.servantErrorEnd(err)
+		return
+	}
+	job, err := jobs.newJob(self.Session)
+	if err != nil {
+		self.servantErrorEnd(err)
+		return
+	}
+	cmd.Stdout = job.stdout
+	switch cmdConf.Stderr {
+	case "merge":
+		cmd.Stderr = job.stdout
+	case "separate":
+		cmd.Stderr = job.stderr
+	}
+	limits, err := startCmd(cmd, &cmdConf.Limits)
+	if err != nil {
+		jobs.remove(job.Id)
+		self.ErrorEnd(http.StatusBadGateway, "execution error: %s", err)
+		return
+	}
+	job.start(cmd, time.Duration(cmdConf.Timeout)*time.Second, func(job *Job, err error) {
+		if err != nil {
+			self.warn("job %d process %d ended with error: %s", job.Id, job.Pid, err.Error())
+		} else {
+			self.info("job %d process %d ended", job.Id, job.Pid)
+		}
+	})
+	self.info("job %d started. pid: %d%s", job.Id, job.Pid, limitsSuffix(limits))
+	self.resp.Header().Set(ServantJobIdHeader, strconv.FormatUint(job.Id, 10))
+	_, err = self.resp.Write([]byte(strconv.FormatUint(job.Id, 10) + "\n"))
+	if err != nil {
+		self.BadEnd("io error: %s", err)
+	} else {
+		self.GoodEnd("execution done")
+	}
+}
+
+type JobServer struct {
+	*Session
+}
+
+func NewJobServer(sess *Session) Handler {
+	return JobServer{
+		Session: sess,
+	}
+}
+
+// /jobs/<group>/<command>[/<id>[/output|/stderr]]
+func (self JobServer) serve() {
+	method := self.req.Method
+	if self.tail == "" || self.tail == "/" {
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		list := jobs.list(self.group, self.item)
+		ret := make([]jobStatus, 0, len(list))
+		for _, job := range list {
+			ret = append(ret, job.Status())
+		}
+		self.JsonEnd(ret)
+		return
+	}
+	segs := strings.Split(strings.Trim(self.tail, "/"), "/")
+	id, err := strconv.ParseUint(segs[0], 10, 64)
+	if err != nil || len(segs) > 2 {
+		self.ErrorEnd(http.StatusNotFound, "bad job path: %s", self.tail)
+		return
+	}
+	job := jobs.get(id)
+	if job == nil || job.Group != self.group || job.Command != self.item {
+		self.ErrorEnd(http.StatusNotFound, "job %d not found", id)
+		return
+	}
+	if len(segs) == 2 {
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		switch segs[1] {
+		case "output":
+			self.serveOutput(job, job.stdout)
+		case "stderr":
+			self.serveOutput(job, job.stderr)
+		default:
+			self.ErrorEnd(http.StatusNotFound, "bad job path: %s", self.tail)
+		}
+		return
+	}
+	switch method {
+	case "GET":
+		self.JsonEnd(job.Status())
+	case "DELETE":
+		if err = job.Kill(); err != nil {
+			self.ErrorEnd(http.StatusConflict, "kill job %d failed: %s", id, err)
+			return
+		}
+		wait := time.NewTimer(jobKillWait)
+		defer wait.Stop()
+		select {
+		case <-job.done:
+			self.info("job %d killed", id)
+		case <-wait.C:
+			// still running, e.g. its output is held open by an escaped child
+			self.warn("job %d not exited %s after killed", id, jobKillWait)
+			self.resp.Header().Set("Content-Type", "application/json")
+			self.resp.WriteHeader(http.StatusAccepted)
+		}
+		self.JsonEnd(job.Status())
+	default:
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+	}
+}
+
+func (self JobServer) serveOutput(job *Job, output *outputBuffer) {
+	var offset int64
+	var err error
+	if offsetStr := self.req.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil {
+			self.ErrorEnd(http.StatusBadRequest, "bad offset: %s", offsetStr)
+			return
+		}
+	}
+	data, start, next := output.Since(offset)
+	header := self.resp.Header()
+	header.Set(ServantJobStateHeader, job.Status().State)
+	header.Set(ServantOutputOffsetHeader, strconv.FormatInt(start, 10))
+	header.Set(ServantOutputNextHeader, strconv.FormatInt(next, 10))
+	_, err = self.resp.Write(data)
+	if err != nil {
+		self.BadEnd("io error: %s", err)
+	} else {
+		self.GoodEnd("output of job %d done", job.Id)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	buf := newOutputBuffer(8)
+	buf.Write([]byte("hello"))
+	data, start, next := buf.Since(0)
+	if string(data) != "hello" || start != 0 || next != 5 {
+		t.Errorf("since 0 wrong: %q %d %d", data, start, next)
+	}
+	buf.Write([]byte(" world"))
+	data, start, next = buf.Since(0)
+	if string(data) != "lo world" || start != 3 || next != 11 {
+		t.Errorf("since 0 wrong: %q %d %d", data, start, next)
+	}
+	data, start, next = buf.Since(6)
+	if string(data) != "world" || start != 6 || next != 11 {
+		t.Errorf("since 6 wrong: %q %d %d", data, start, next)
+	}
+	data, start, _ = buf.Since(-3)
+	if string(data) != "rld" || start != 8 {
+		t.Errorf("since -3 wrong: %q %d", data, start)
+	}
+	data, start, _ = buf.Since(100)
+	if len(data) != 0 || start != 11 {
+		t.Errorf("since 100 wrong: %q %d", data, start)
+	}
+	buf.Write([]byte("!!"))
+	data, start, next = buf.Since(0)
+	if string(data) != " world!!" || start != 5 || next != 13 {
+		t.Errorf("since 0 after wrapped wrong: %q %d %d", data, start, next)
+	}
+	data, start, _ = buf.Since(10)
+	if string(data) != "d!!" || start != 10 {
+		t.Errorf("since 10 after wrapped wrong: %q %d", data, start)
+	}
+	buf.Write([]byte("0123456789"))
+	data, start, next = buf.Since(0)
+	if string(data) != "23456789" || start != 15 || next != 23 {
+		t.Errorf("since 0 after large write wrong: %q %d %d", data, start, next)
+	}
+	for i := 0; i < 5; i++ {
+		buf.Write([]byte("abc"))
+	}
+	data, start, _ = buf.Since(0)
+	if string(data) != "bcabcabc" || start != 30 {
+		t.Errorf("since 0 after many writes wrong: %q %d", data, start)
+	}
+}
+
+func TestJobTablePrune(t *testing.T) {
+	table := newJobTable(conf.Jobs{Max: 2, Retention: 10})
+	sess := &Session{group: "g", item: "c"}
+	j1, _ := table.newJob(sess)
+	j2, _ := table.newJob(sess)
+	if _, err := table.newJob(sess); err == nil {
+		t.Error("table should be full")
+	}
+	now := time.Now()
+	j1.State, j1.EndTime = JobExited, now.Add(-time.Second)
+	j2.State = JobRunning
+	j3, err := table.newJob(sess)
+	if err != nil {
+		t.Fatalf("oldest finished job should be evicted: %s", err)
+	}
+	if table.get(j1.Id) != nil || table.get(j2.Id) == nil || table.get(j3.Id) == nil {
+		t.Error("wrong job evicted")
+	}
+	j3.State, j3.EndTime = JobExited, now.Add(-time.Minute)
+	if list := table.list("g", "c"); len(list) != 1 || list[0] != j2 {
+		t.Error("expired job should be removed")
+	}
+}
+
+func TestServeJob(t *testing.T) {
+	req := httptest.NewRequest("GET", "/commands/g/c", nil)
+	resp := httptest.NewRecorder()
+	server := CommandServer{Session: &Session{req: req, resp: resp, resource: "commands", group: "g", item: "c"}}
+	server.serveCommand(&conf.Command{
+		Lang:       "bash",
+		Code:       "echo hello; sleep 10",
+		Timeout:    5,
+		Background: true,
+	})
+	id, err := strconv.ParseUint(resp.Header().Get(ServantJobIdHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("bad job id: %s", err)
+	}
+	job := jobs.get(id)
+	if job == nil {
+		t.Fatal("job should exists")
+	}
+	for i := 0; i < 100 && job.stdout.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest("GET", "/jobs/g/c/"+strconv.FormatUint(id, 10)+"/output", nil)
+	resp = httptest.NewRecorder()
+	NewJobServer(&Session{req: req, resp: resp, resource: "jobs", group: "g", item: "c", tail: "/" + strconv.FormatUint(id, 10) + "/output"}).serve()
+	if resp.Body.String() != "hello\n" || resp.Header().Get(ServantOutputNextHeader) != "6" {
+		t.Errorf("output wrong: %q", resp.Body.String())
+	}
+
+	if running := job.Status(); running.End != nil {
+		t.Errorf("end of running job should be omitted")
+	}
+
+	req = httptest.NewRequest("DELETE", "/jobs/g/c/"+strconv.FormatUint(id, 10), nil)
+	resp = httptest.NewRecorder()
+	NewJobServer(&Session{req: req, resp: resp, resource: "jobs", group: "g", item: "c", tail: "/" + strconv.FormatUint(id, 10)}).serve()
+	var status jobStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+		t.Fatalf("bad status: %s", err)
+	}
+	if status.State != JobKilled || status.Signal != 9 {
+		t.Errorf("job should be killed: %+v", status)
+	}
+	if status.End == nil {
+		t.Errorf("end of exited job should be set")
+	}
+
+	req = httptest.NewRequest("GET", "/jobs/g/x/"+strconv.FormatUint(id, 10), nil)
+	resp = httptest.NewRecorder()
+	NewJobServer(&Session{req: req, resp: resp, resource: "jobs", group: "g", item: "x", tail: "/" + strconv.FormatUint(id, 10)}).serve()
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("job of other command should not be found: %d", resp.Code)
+	}
+}
+
+func TestKillJobWait(t *testing.T) {
+	defer func(d time.Duration) {
+		jobKillWait = d
+	}(jobKillWait)
+	jobKillWait = 100 * time.Millisecond
+	req := httptest.NewRequest("GET", "/commands/g/c", nil)
+	resp := httptest.NewRecorder()
+	server := CommandServer{Session: &Session{req: req, resp: resp, resource: "commands", group: "g", item: "c"}}
+	// the escaped child keeps the output open after the job is killed
+	server.serveCommand(&conf.Command{
+		Lang:       "bash",
+		Code:       "setsid sleep 2 & echo hello; sleep 10",
+		Timeout:    5,
+		Background: true,
+	})
+	id, err := strconv.ParseUint(resp.Header().Get(ServantJobIdHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("bad job id: %s", err)
+	}
+	job := jobs.get(id)
+	for i := 0; i < 100 && job.stdout.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest("DELETE", "/jobs/g/c/"+strconv.FormatUint(id, 10), nil)
+	resp = httptest.NewRecorder()
+	start := time.Now()
+	NewJobServer(&Session{req: req, resp: resp, resource: "jobs", group: "g", item: "c", tail: "/" + strconv.FormatUint(id, 10)}).serve()
+	if resp.Code != http.StatusAccepted || time.Since(start) > time.Second {
+		t.Errorf("kill should not wait for the escaped child: %d %s", resp.Code, time.Since(start))
+	}
+	var status jobStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil || status.State != JobRunning {
+		t.Errorf("job should be still running: %+v %v", status, err)
+	}
+	<-job.done
+	if status := job.Status(); status.State != JobKilled {
+		t.Errorf("job should be killed: %+v", status)
+	}
+}
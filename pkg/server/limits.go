@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"strconv"
+	"strings"
+)
+
+const (
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+)
+
+// parseSize parses sizes like 1024, 512k, 64M, 1G
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	case 'g', 'G':
+		unit = 1 << 30
+	case 't', 'T':
+		unit = 1 << 40
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// parseIonice parses io priorities like idle, be:4, rt:0, or 4 as a best-effort level
+func parseIonice(s string) (class int, level int, err error) {
+	if s == "idle" {
+		return ioprioClassIdle, 0, nil
+	}
+	class = ioprioClassBE
+	levelStr := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		switch s[:i] {
+		case "rt":
+			class = ioprioClassRT
+		case "be":
+			class = ioprioClassBE
+		default:
+			return 0, 0, fmt.Errorf("bad ionice class: %s", s)
+		}
+		levelStr = s[i+1:]
+	}
+	level, err = strconv.Atoi(levelStr)
+	if err != nil || level < 0 || level > 7 {
+		return 0, 0, fmt.Errorf("bad ionice level: %s", s)
+	}
+	return class, level, nil
+}
+
+func checkLimits(limits *conf.Limits) error {
+	if limits.Memory != "" {
+		if _, err := parseSize(limits.Memory); err != nil {
+			return err
+		}
+	}
+	if limits.Ionice != "" {
+		if _, _, err := parseIonice(limits.Ionice); err != nil {
+			return err
+		}
+	}
+	if limits.Cpu < 0 {
+		return fmt.Errorf("bad cpu: %d", limits.Cpu)
+	}
+	if limits.Nice < -20 || limits.Nice > 19 {
+		return fmt.Errorf("bad nice: %d", limits.Nice)
+	}
+	return nil
+}
+
+func hasLimits(limits *conf.Limits) bool {
+	return *limits != conf.Limits{}
+}
+
+func describeLimits(limits *conf.Limits, cgroup string) string {
+	ret := make([]string, 0, 7)
+	if cgroup != "" {
+		ret = append(ret, "cgroup="+cgroup)
+	}
+	if limits.Memory != "" {
+		ret = append(ret, "memory="+limits.Memory)
+	}
+	if limits.Cpu > 0 {
+		if cgroup != "" {
+			ret = append(ret, fmt.Sprintf("cpu=%d%%", limits.Cpu))
+		} else {
+			ret = append(ret, "cpu=unlimited")
+		}
+	}
+	if limits.Nofile > 0 {
+		ret = append(ret, fmt.Sprintf("nofile=%d", limits.Nofile))
+	}
+	if limits.Nproc > 0 {
+		ret = append(ret, fmt.Sprintf("nproc=%d", limits.Nproc))
+	}
+	if limits.Nice != 0 {
+		ret = append(ret, fmt.Sprintf("nice=%d", limits.Nice))
+	}
+	if limits.Ionice != "" {
+		ret = append(ret, "ionice="+limits.Ionice)
+	}
+	return strings.Join(ret, " ")
+}
+
+func limitsSuffix(limits string) string {
+	if limits == "" {
+		return ""
+	}
+	return ", limits: " + limits
+}
@@ -0,0 +1,331 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+const cgroupServantDir = "servant"
+const cgroup2SuperMagic = 0x63677270
+const cpuPeriod = 100000
+
+const rlimitNproc = 6
+const ioprioWhoProcess = 1
+const ioprioClassShift = 13
+
+var cgroupOnce sync.Once
+var cgroupAvailable bool
+var cgroupSeq uint64
+
+// cgroupUsable checks whether servant runs as root and cgroup v2 is mounted,
+// and prepares the servant cgroup which per execution cgroups are created in.
+func cgroupUsable() bool {
+	cgroupOnce.Do(func() {
+		if os.Geteuid() != 0 {
+			return
+		}
+		var st syscall.Statfs_t
+		if syscall.Statfs(cgroupRoot, &st) != nil || st.Type != cgroup2SuperMagic {
+			return
+		}
+		dir := filepath.Join(cgroupRoot, cgroupServantDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Printf("WARN (_) [limits] create cgroup %s failed: %s", dir, err)
+			return
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0644)
+		if err != nil {
+			logger.Printf("WARN (_) [limits] enable cgroup controllers failed: %s", err)
+			return
+		}
+		cgroupAvailable = true
+	})
+	return cgroupAvailable
+}
+
+// prepareLimits checks the limits. The cgroup of the command is created when it starts, see startCmd.
+func prepareLimits(cmd *exec.Cmd, limits *conf.Limits) error {
+	return checkLimits(limits)
+}
+
+// cgroups of started commands, removed after the commands are waited
+var cmdCgroups = make(map[*exec.Cmd]string)
+var cmdCgroupsLock sync.Mutex
+
+// newCgroup creates a cgroup for a command with the limits, returns its dir and an fd of it,
+// or an empty dir if no cgroup is needed or cgroup is not usable
+func newCgroup(limits *conf.Limits) (string, int, error) {
+	if limits.Memory == "" && limits.Cpu == 0 && limits.Nproc == 0 {
+		return "", -1, nil
+	}
+	if !cgroupUsable() {
+		return "", -1, nil
+	}
+	dir := filepath.Join(cgroupRoot, cgroupServantDir,
+		fmt.Sprintf("exec-%d-%d", os.Getpid(), atomic.AddUint64(&cgroupSeq, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", -1, err
+	}
+	settings := make(map[string]string)
+	if limits.Memory != "" {
+		memory, _ := parseSize(limits.Memory)
+		settings["memory.max"] = strconv.FormatInt(memory, 10)
+	}
+	if limits.Cpu > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", limits.Cpu*cpuPeriod/100, cpuPeriod)
+	}
+	if limits.Nproc > 0 {
+		settings["pids.max"] = strconv.FormatUint(limits.Nproc, 10)
+	}
+	for name, value := range settings {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+			_ = syscall.Rmdir(dir)
+			return "", -1, fmt.Errorf("set %s failed: %s", name, err)
+		}
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		_ = syscall.Rmdir(dir)
+		return "", -1, err
+	}
+	return dir, fd, nil
+}
+
+// releaseLimits removes the cgroup of the command, must be called after the command is waited
+func releaseLimits(cmd *exec.Cmd) {
+	cmdCgroupsLock.Lock()
+	dir, ok := cmdCgroups[cmd]
+	delete(cmdCgroups, cmd)
+	cmdCgroupsLock.Unlock()
+	if ok {
+		if err := syscall.Rmdir(dir); err != nil {
+			logger.Printf("WARN (_) [limits] remove cgroup %s failed: %s", dir, err)
+		}
+	}
+}
+
+// limitsWrapperName is argv[0] of servant itself run as a wrapper of a command,
+// which applies limits to itself, then execs the command, so that the command never runs without limits.
+// args of the wrapper: <limits spec> <command path> <command args...>
+const limitsWrapperName = "servant-limits"
+
+func init() {
+	if len(os.Args) > 2 && os.Args[0] == limitsWrapperName {
+		runLimitsWrapper(os.Args[1], os.Args[2], os.Args[3:])
+	}
+}
+
+// startCmd starts the command in a new cgroup if possible, with other limits applied before it runs,
+// returns the effective limits. releaseLimits must be called after the command is waited.
+func startCmd(cmd *exec.Cmd, limits *conf.Limits) (string, error) {
+	if cmd.Err != nil {
+		return "", cmd.Start()
+	}
+	cgroup, fd, err := newCgroup(limits)
+	if err != nil {
+		return "", fmt.Errorf("create cgroup failed: %s", err)
+	}
+	inCgroup := cgroup != ""
+	if inCgroup {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+		defer func() {
+			_ = syscall.Close(fd)
+			cmd.SysProcAttr.UseCgroupFD = false
+		}()
+	}
+	spec := limitsSpec(limits, inCgroup)
+	if len(spec) == 0 {
+		err = cmd.Start()
+	} else {
+		err = startLimitsWrapper(cmd, spec)
+	}
+	if err != nil {
+		if inCgroup {
+			_ = syscall.Rmdir(cgroup)
+		}
+		return "", err
+	}
+	if inCgroup {
+		cmdCgroupsLock.Lock()
+		cmdCgroups[cmd] = cgroup
+		cmdCgroupsLock.Unlock()
+	}
+	return describeLimits(limits, cgroup), nil
+}
+
+// limitsSpec lists limits the wrapper applies, those in cgroup are applied on clone
+func limitsSpec(limits *conf.Limits, inCgroup bool) []string {
+	ret := make([]string, 0, 5)
+	if !inCgroup {
+		if limits.Memory != "" {
+			memory, _ := parseSize(limits.Memory)
+			ret = append(ret, fmt.Sprintf("as=%d", memory))
+		}
+		if limits.Nproc > 0 {
+			ret = append(ret, fmt.Sprintf("nproc=%d", limits.Nproc))
+		}
+	}
+	if limits.Nofile > 0 {
+		ret = append(ret, fmt.Sprintf("nofile=%d", limits.Nofile))
+	}
+	if limits.Nice != 0 {
+		ret = append(ret, fmt.Sprintf("nice=%d", limits.Nice))
+	}
+	if limits.Ionice != "" {
+		class, level, _ := parseIonice(limits.Ionice)
+		ret = append(ret, fmt.Sprintf("ioprio=%d", class<<ioprioClassShift|level))
+	}
+	return ret
+}
+
+// startLimitsWrapper starts the wrapper in place of the command, and waits until it execs the command.
+// The wrapper reports errors through a pipe, which is closed on exec.
+// Credential is taken by the wrapper too, as limits like negative nice need root.
+func startLimitsWrapper(cmd *exec.Cmd, spec []string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	spec = append(spec, fmt.Sprintf("status=%d", 3+len(cmd.ExtraFiles)))
+	cred := cmd.SysProcAttr.Credential
+	if cred != nil {
+		spec = append(spec, fmt.Sprintf("uid=%d", cred.Uid), fmt.Sprintf("gid=%d", cred.Gid))
+		if !cred.NoSetGroups {
+			groups := make([]string, len(cred.Groups))
+			for i, group := range cred.Groups {
+				groups[i] = strconv.FormatUint(uint64(group), 10)
+			}
+			spec = append(spec, "groups="+strings.Join(groups, ":"))
+		}
+	}
+	path, args, extraFiles := cmd.Path, cmd.Args, cmd.ExtraFiles
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = append([]string{limitsWrapperName, strings.Join(spec, ","), path}, args...)
+	cmd.ExtraFiles = append(extraFiles[:len(extraFiles):len(extraFiles)], w)
+	cmd.SysProcAttr.Credential = nil
+	err = cmd.Start()
+	cmd.Path, cmd.Args, cmd.ExtraFiles = path, args, extraFiles
+	cmd.SysProcAttr.Credential = cred
+	w.Close()
+	if err != nil {
+		return err
+	}
+	msg, _ := ioutil.ReadAll(r)
+	if len(msg) > 0 {
+		// do not let it run without limits
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// runLimitsWrapper runs in the wrapper process, and never returns
+func runLimitsWrapper(spec, path string, args []string) {
+	status := os.Stderr
+	err := func() error {
+		values := make(map[string]string)
+		for _, kv := range strings.Split(spec, ",") {
+			if i := strings.Index(kv, "="); i > 0 {
+				values[kv[:i]] = kv[i+1:]
+			}
+		}
+		if fd, err := strconv.Atoi(values["status"]); err == nil {
+			status = os.NewFile(uintptr(fd), "status")
+			syscall.CloseOnExec(fd)
+		}
+		if err := applyLimits(values); err != nil {
+			return err
+		}
+		if err := setCredential(values); err != nil {
+			return err
+		}
+		return syscall.Exec(path, args, os.Environ())
+	}()
+	status.Write([]byte(err.Error()))
+	os.Exit(127)
+}
+
+func applyLimits(values map[string]string) error {
+	rlimits := []struct {
+		name     string
+		resource int
+	}{{"as", syscall.RLIMIT_AS}, {"nproc", rlimitNproc}, {"nofile", syscall.RLIMIT_NOFILE}}
+	for _, rlimit := range rlimits {
+		if v, ok := values[rlimit.name]; ok {
+			value, _ := strconv.ParseUint(v, 10, 64)
+			if err := prlimit(0, rlimit.resource, value); err != nil {
+				return fmt.Errorf("set %s limit failed: %s", rlimit.name, err)
+			}
+		}
+	}
+	if v, ok := values["nice"]; ok {
+		nice, _ := strconv.Atoi(v)
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+			return fmt.Errorf("set nice failed: %s", err)
+		}
+	}
+	if v, ok := values["ioprio"]; ok {
+		prio, _ := strconv.Atoi(v)
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+		if errno != 0 {
+			return fmt.Errorf("set ionice failed: %s", errno)
+		}
+	}
+	return nil
+}
+
+func setCredential(values map[string]string) error {
+	if v, ok := values["groups"]; ok {
+		groups := make([]int, 0)
+		for _, g := range strings.FieldsFunc(v, func(r rune) bool { return r == ':' }) {
+			gid, _ := strconv.Atoi(g)
+			groups = append(groups, gid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("set groups failed: %s", err)
+		}
+	}
+	if v, ok := values["gid"]; ok {
+		gid, _ := strconv.Atoi(v)
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("set gid failed: %s", err)
+		}
+	}
+	if v, ok := values["uid"]; ok {
+		uid, _ := strconv.Atoi(v)
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("set uid failed: %s", err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid int, resource int, value uint64) error {
+	rlim := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(&rlim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCommandLimits(t *testing.T) {
+	req := httptest.NewRequest("GET", "/commands/g/c", nil)
+	resp := httptest.NewRecorder()
+	server := CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "ulimit -n",
+		Timeout: 5,
+		Limits:  conf.Limits{Nofile: 123},
+	})
+	if resp.Body.String() != "123\n" {
+		t.Errorf("nofile limit not applied: %q", resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "exec",
+		Code:    "nice",
+		Timeout: 5,
+		Limits:  conf.Limits{Nice: 5, Nofile: 100},
+	})
+	if resp.Body.String() != "5\n" {
+		t.Errorf("nice not applied: %q", resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "echo started",
+		Timeout: 5,
+		Limits:  conf.Limits{Nofile: 1 << 40},
+	})
+	if resp.Code != 502 || resp.Body.String() == "started\n" {
+		t.Errorf("command should not run when limits fail: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	server = CommandServer{Session: &Session{req: req, resp: resp, resource: "commands"}}
+	server.serveCommand(&conf.Command{
+		Lang:    "bash",
+		Code:    "true",
+		Timeout: 5,
+		Limits:  conf.Limits{Memory: "xx"},
+	})
+	if resp.Code != 500 {
+		t.Errorf("bad limits should fail: %d", resp.Code)
+	}
+}
+
+func TestCmdCgroup(t *testing.T) {
+	if !cgroupUsable() {
+		t.Skip("cgroup v2 is not usable")
+	}
+	cmd := exec.Command("cat", "/proc/self/cgroup")
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	limits, err := startCmd(cmd, &conf.Limits{Memory: "64M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	cmdCgroupsLock.Lock()
+	dir := cmdCgroups[cmd]
+	cmdCgroupsLock.Unlock()
+	if dir == "" || !strings.Contains(limits, dir) || !strings.Contains(out.String(), filepath.Base(dir)) {
+		t.Errorf("command should run in its cgroup: %s %q", limits, out.String())
+	}
+	releaseLimits(cmd)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cgroup should be removed after waited: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"os/exec"
+)
+
+func prepareLimits(cmd *exec.Cmd, limits *conf.Limits) error {
+	if hasLimits(limits) {
+		return fmt.Errorf("resource limits are only supported on linux")
+	}
+	return nil
+}
+
+func startCmd(cmd *exec.Cmd, limits *conf.Limits) (string, error) {
+	return "", cmd.Start()
+}
+
+func releaseLimits(cmd *exec.Cmd) {
+}
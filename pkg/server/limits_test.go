@@ -0,0 +1,55 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"1024": 1024,
+		"2k":   2048,
+		"64M":  64 << 20,
+		"1g":   1 << 30,
+	}
+	for s, expected := range cases {
+		if n, err := parseSize(s); err != nil || n != expected {
+			t.Errorf("parse %s wrong: %d %v", s, n, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1k", "1x", "abc"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parse %s should fail", s)
+		}
+	}
+}
+
+func TestParseIonice(t *testing.T) {
+	if c, l, err := parseIonice("idle"); err != nil || c != ioprioClassIdle || l != 0 {
+		t.Error("idle wrong")
+	}
+	if c, l, err := parseIonice("4"); err != nil || c != ioprioClassBE || l != 4 {
+		t.Error("4 wrong")
+	}
+	if c, l, err := parseIonice("rt:0"); err != nil || c != ioprioClassRT || l != 0 {
+		t.Error("rt:0 wrong")
+	}
+	for _, s := range []string{"8", "xx:1", "be:", "be:-1"} {
+		if _, _, err := parseIonice(s); err == nil {
+			t.Errorf("parse %s should fail", s)
+		}
+	}
+}
+
+func TestDescribeLimits(t *testing.T) {
+	limits := conf.Limits{Memory: "64M", Cpu: 50, Nofile: 100, Nice: 5}
+	if s := describeLimits(&limits, ""); s != "memory=64M cpu=unlimited nofile=100 nice=5" {
+		t.Errorf("describe wrong: %s", s)
+	}
+	if s := describeLimits(&limits, "/sys/fs/cgroup/servant/exec-1-1"); s != "cgroup=/sys/fs/cgroup/servant/exec-1-1 memory=64M cpu=50% nofile=100 nice=5" {
+		t.Errorf("describe wrong: %s", s)
+	}
+	if hasLimits(&conf.Limits{}) || !hasLimits(&limits) {
+		t.Error("hasLimits wrong")
+	}
+}
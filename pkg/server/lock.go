@@ -1,6 +1,9 @@
 package server
 
 import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,29 +12,295 @@ type Lock interface {
 	With(func())
 	TryWith(func()) bool
 	TimeoutWith(d time.Duration, f func()) bool
+	SharedWith(func())
+	TrySharedWith(func()) bool
+	TimeoutSharedWith(d time.Duration, f func()) bool
 }
 
+// DefaultSharedPermits is the max shared holders of a shared/exclusive lock without permits set
+const DefaultSharedPermits = 1024
+
+// ChanLock is a mutex, or a counting semaphore when it has more than one permit
 type ChanLock chan struct{}
 
 func NewChanLock() ChanLock {
 	return make(chan struct{}, 1)
 }
 
-var locks = make(map[string]Lock)
+func NewSemaphore(permits int) ChanLock {
+	return make(chan struct{}, permits)
+}
+
+// LockOwner describes who holds or waits for a lock
+type LockOwner struct {
+	Session  uint64    `json:"session"`
+	Username string    `json:"user"`
+	Command  string    `json:"command"`
+	Shared   bool      `json:"shared"`
+	Since    time.Time `json:"since"`
+}
+
+// NamedLock records holders and waiters of a lock to be inspected
+type NamedLock struct {
+	Lock
+	name    string
+	kind    string
+	permits int
+	// users of the lock got by GetConfLock, guarded by lockMapMutex.
+	// A file lock is removed when no one uses it.
+	users   int
+	mutex   sync.Mutex
+	holders map[*LockOwner]struct{}
+	waiters map[*LockOwner]struct{}
+}
+
+type lockStatus struct {
+	Name    string      `json:"name"`
+	Kind    string      `json:"kind"`
+	Permits int         `json:"permits"`
+	Holders []LockOwner `json:"holders"`
+	Waiters []LockOwner `json:"waiters"`
+}
+
+var locks = make(map[string]*NamedLock)
 var lockMapMutex sync.Mutex
 
-func GetLock(name string) Lock {
+func GetLock(name string) *NamedLock {
+	return getLock(name, func() (Lock, string, int) {
+		return NewChanLock(), "mutex", 1
+	})
+}
+
+// GetConfLock gets the lock configured. The lock is created by the first config seen,
+// so configs of the same lock name should be identical. File locks are distinguished by files.
+// The lock should be released by releaseLock after used, as vars may be expanded to many files,
+// and locks not in use can be changed by reloading.
+func GetConfLock(lockConf *conf.Lock) *NamedLock {
+	lockMapMutex.Lock()
+	defer lockMapMutex.Unlock()
+	var lock *NamedLock
+	if lockConf.File != "" {
+		lock = getLockLocked(lockConf.Name+":"+lockConf.File, func() (Lock, string, int) {
+			return NewFileLock(lockConf.File), conf.LockKindFile, 1
+		})
+	} else {
+		lock = getLockLocked(lockConf.Name, func() (Lock, string, int) {
+			kind, permits := confLockKind(lockConf)
+			switch kind {
+			case conf.LockKindRW:
+				return NewRWChanLock(permits), kind, permits
+			case conf.LockKindSemaphore:
+				return NewSemaphore(permits), kind, permits
+			default:
+				return NewChanLock(), kind, permits
+			}
+		})
+	}
+	lock.users++
+	return lock
+}
+
+// confLockKind returns the kind and permits of the lock configured, except file locks
+func confLockKind(lockConf *conf.Lock) (string, int) {
+	switch lockConf.Kind() {
+	case conf.LockKindRW:
+		if lockConf.Permits <= 0 {
+			return conf.LockKindRW, DefaultSharedPermits
+		}
+		return conf.LockKindRW, lockConf.Permits
+	case conf.LockKindSemaphore:
+		return conf.LockKindSemaphore, lockConf.Permits
+	default:
+		return conf.LockKindMutex, 1
+	}
+}
+
+// releaseLock removes a file lock when no one holds or waits for it
+func releaseLock(lock *NamedLock) {
+	lockMapMutex.Lock()
+	defer lockMapMutex.Unlock()
+	lock.users--
+	if lock.kind == conf.LockKindFile && lock.users <= 0 && locks[lock.name] == lock {
+		delete(locks, lock.name)
+	}
+}
+
+// reloadLocks removes locks changed by the new config, which are created again when used.
+// Locks in use are kept, and need restarting to apply the changes.
+func reloadLocks(config *conf.Config) {
+	lockMapMutex.Lock()
+	defer lockMapMutex.Unlock()
+	for name, lockConf := range conf.Locks(config) {
+		lock, ok := locks[name]
+		if !ok || lockConf.File != "" {
+			continue
+		}
+		if kind, permits := confLockKind(lockConf); kind == lock.kind && permits == lock.permits {
+			continue
+		}
+		if lock.users > 0 {
+			logger.Printf("WARN (_) [lock] lock %s changed but in use, restart to apply it", name)
+			continue
+		}
+		delete(locks, name)
+		logger.Printf("INFO (_) [lock] lock %s changed", name)
+	}
+}
+
+func getLock(name string, newLock func() (Lock, string, int)) *NamedLock {
 	lockMapMutex.Lock()
 	defer lockMapMutex.Unlock()
+	return getLockLocked(name, newLock)
+}
+
+func getLockLocked(name string, newLock func() (Lock, string, int)) *NamedLock {
 	lock, ok := locks[name]
 	if ok {
 		return lock
 	}
-	lock = NewChanLock()
+	l, kind, permits := newLock()
+	lock = &NamedLock{
+		Lock:    l,
+		name:    name,
+		kind:    kind,
+		permits: permits,
+		holders: make(map[*LockOwner]struct{}),
+		waiters: make(map[*LockOwner]struct{}),
+	}
 	locks[name] = lock
 	return lock
 }
 
+// failableLock is a lock which may fail to be acquired for errors, besides held by others
+type failableLock interface {
+	tryWith(shared bool, d time.Duration, f func()) (bool, error)
+}
+
+// withConfLock runs f holding the lock configured, returns false if the lock is not acquired,
+// or an error if it fails to acquire the lock
+func withConfLock(lockConf *conf.Lock, owner LockOwner, f func()) (bool, error) {
+	if lockConf.Name == "" {
+		f()
+		return true, nil
+	}
+	lock := GetConfLock(lockConf)
+	defer releaseLock(lock)
+	owner.Shared = lockConf.Mode == conf.LockModeShared
+	if lockConf.Wait {
+		return lock.TimeoutWithOwner(owner, time.Duration(lockConf.Timeout)*time.Second, f)
+	}
+	return lock.TryWithOwner(owner, f)
+}
+
+func (self *NamedLock) TryWithOwner(owner LockOwner, f func()) (bool, error) {
+	held := func() {
+		self.hold(&owner, f)
+	}
+	if l, ok := self.Lock.(failableLock); ok {
+		return l.tryWith(owner.Shared, 0, held)
+	}
+	tryWith := self.Lock.TryWith
+	if owner.Shared {
+		tryWith = self.Lock.TrySharedWith
+	}
+	return tryWith(held), nil
+}
+
+func (self *NamedLock) TimeoutWithOwner(owner LockOwner, d time.Duration, f func()) (bool, error) {
+	waiter := owner
+	waiter.Since = time.Now()
+	self.mutex.Lock()
+	self.waiters[&waiter] = struct{}{}
+	self.mutex.Unlock()
+	defer self.removeWaiter(&waiter)
+	held := func() {
+		self.removeWaiter(&waiter)
+		self.hold(&owner, f)
+	}
+	if l, ok := self.Lock.(failableLock); ok {
+		return l.tryWith(owner.Shared, d, held)
+	}
+	timeoutWith := self.Lock.TimeoutWith
+	if owner.Shared {
+		timeoutWith = self.Lock.TimeoutSharedWith
+	}
+	return timeoutWith(d, held), nil
+}
+
+func (self *NamedLock) removeWaiter(waiter *LockOwner) {
+	self.mutex.Lock()
+	delete(self.waiters, waiter)
+	self.mutex.Unlock()
+}
+
+func (self *NamedLock) hold(owner *LockOwner, f func()) {
+	owner.Since = time.Now()
+	self.mutex.Lock()
+	self.holders[owner] = struct{}{}
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		delete(self.holders, owner)
+		self.mutex.Unlock()
+	}()
+	f()
+}
+
+func (self *NamedLock) Status() lockStatus {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	ret := lockStatus{
+		Name:    self.name,
+		Kind:    self.kind,
+		Permits: self.permits,
+		Holders: sortedOwners(self.holders),
+		Waiters: sortedOwners(self.waiters),
+	}
+	return ret
+}
+
+func sortedOwners(owners map[*LockOwner]struct{}) []LockOwner {
+	ret := make([]LockOwner, 0, len(owners))
+	for owner := range owners {
+		ret = append(ret, *owner)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Since.Before(ret[j].Since) })
+	return ret
+}
+
+func lockStatuses() []lockStatus {
+	lockMapMutex.Lock()
+	all := make([]*NamedLock, 0, len(locks))
+	for _, lock := range locks {
+		all = append(all, lock)
+	}
+	lockMapMutex.Unlock()
+	ret := make([]lockStatus, 0, len(all))
+	for _, lock := range all {
+		ret = append(ret, lock.Status())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+type LockServer struct {
+	*Session
+}
+
+func NewLockServer(sess *Session) Handler {
+	return LockServer{
+		Session: sess,
+	}
+}
+
+func (self LockServer) serve() {
+	if self.req.Method != "GET" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", self.req.Method)
+		return
+	}
+	self.JsonEnd(lockStatuses())
+}
+
 func (self ChanLock) lock() {
 	self <- struct{}{}
 }
@@ -83,3 +352,141 @@ func (self ChanLock) TimeoutWith(d time.Duration, f func()) bool {
 	f()
 	return true
 }
+
+// shared holders of a ChanLock just take one permit as others
+func (self ChanLock) SharedWith(f func()) {
+	self.With(f)
+}
+
+func (self ChanLock) TrySharedWith(f func()) bool {
+	return self.TryWith(f)
+}
+
+func (self ChanLock) TimeoutSharedWith(d time.Duration, f func()) bool {
+	return self.TimeoutWith(d, f)
+}
+
+// RWChanLock can be held by shared holders concurrently up to its permits,
+// or by one exclusive holder. An exclusive holder takes all the permits, one by one,
+// after it takes the writer token, which also blocks new shared holders meanwhile.
+type RWChanLock struct {
+	slots  ChanLock
+	writer ChanLock
+}
+
+func NewRWChanLock(permits int) *RWChanLock {
+	return &RWChanLock{
+		slots:  NewSemaphore(permits),
+		writer: NewChanLock(),
+	}
+}
+
+func (self *RWChanLock) unlockSlots(n int) {
+	for i := 0; i < n; i++ {
+		self.slots.unlock()
+	}
+}
+
+func (self *RWChanLock) lockExclusive(deadline <-chan time.Time) bool {
+	select {
+	case self.writer <- struct{}{}:
+	case <-deadline:
+		return false
+	}
+	for i := 0; i < cap(self.slots); i++ {
+		select {
+		case self.slots <- struct{}{}:
+		case <-deadline:
+			self.unlockSlots(i)
+			self.writer.unlock()
+			return false
+		}
+	}
+	self.writer.unlock()
+	return true
+}
+
+func (self *RWChanLock) lockShared(deadline <-chan time.Time) bool {
+	select {
+	case self.writer <- struct{}{}:
+	case <-deadline:
+		return false
+	}
+	defer self.writer.unlock()
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+func (self *RWChanLock) tryLockExclusive() bool {
+	if !self.writer.tryLock() {
+		return false
+	}
+	defer self.writer.unlock()
+	for i := 0; i < cap(self.slots); i++ {
+		if !self.slots.tryLock() {
+			self.unlockSlots(i)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *RWChanLock) tryLockShared() bool {
+	if !self.writer.tryLock() {
+		return false
+	}
+	defer self.writer.unlock()
+	return self.slots.tryLock()
+}
+
+func (self *RWChanLock) With(f func()) {
+	self.lockExclusive(nil)
+	defer self.unlockSlots(cap(self.slots))
+	f()
+}
+
+func (self *RWChanLock) TryWith(f func()) bool {
+	if !self.tryLockExclusive() {
+		return false
+	}
+	defer self.unlockSlots(cap(self.slots))
+	f()
+	return true
+}
+
+func (self *RWChanLock) TimeoutWith(d time.Duration, f func()) bool {
+	if !self.lockExclusive(time.After(d)) {
+		return false
+	}
+	defer self.unlockSlots(cap(self.slots))
+	f()
+	return true
+}
+
+func (self *RWChanLock) SharedWith(f func()) {
+	self.lockShared(nil)
+	defer self.slots.unlock()
+	f()
+}
+
+func (self *RWChanLock) TrySharedWith(f func()) bool {
+	if !self.tryLockShared() {
+		return false
+	}
+	defer self.slots.unlock()
+	f()
+	return true
+}
+
+func (self *RWChanLock) TimeoutSharedWith(d time.Duration, f func()) bool {
+	if !self.lockShared(time.After(d)) {
+		return false
+	}
+	defer self.slots.unlock()
+	f()
+	return true
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/xiezhenye/servant/pkg/conf"
 	"sync"
 	"testing"
 	"time"
@@ -55,3 +56,150 @@ func TestLock(t *testing.T) {
 	}
 	time.Sleep(200 * time.Millisecond)
 }
+
+func TestNamedLockStatus(t *testing.T) {
+	lock := GetLock("test_status")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go lock.TryWithOwner(LockOwner{Session: 1, Username: "u1", Command: "/commands/g/c1"}, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	go lock.TimeoutWithOwner(LockOwner{Session: 2, Username: "u2", Command: "/commands/g/c2"}, time.Second, func() {})
+	time.Sleep(100 * time.Millisecond)
+
+	var status lockStatus
+	for _, s := range lockStatuses() {
+		if s.Name == "test_status" {
+			status = s
+		}
+	}
+	if len(status.Holders) != 1 || status.Holders[0].Session != 1 || status.Holders[0].Command != "/commands/g/c1" {
+		t.Errorf("holders wrong: %v", status.Holders)
+	}
+	if len(status.Waiters) != 1 || status.Waiters[0].Username != "u2" || status.Waiters[0].Since.IsZero() {
+		t.Errorf("waiters wrong: %v", status.Waiters)
+	}
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	status = lock.Status()
+	if len(status.Holders) != 0 || len(status.Waiters) != 0 {
+		t.Errorf("lock should be free: %v", status)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	lock := NewSemaphore(2)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go lock.TryWith(func() {
+			wg.Done()
+			<-release
+		})
+	}
+	wg.Wait()
+	if lock.TryWith(func() {}) {
+		t.Error("third try should fail")
+	}
+	if lock.TimeoutWith(50*time.Millisecond, func() {}) {
+		t.Error("third wait should timeout")
+	}
+	close(release)
+	if !lock.TimeoutWith(time.Second, func() {}) {
+		t.Error("should acquire after released")
+	}
+}
+
+func TestRWChanLock(t *testing.T) {
+	lock := NewRWChanLock(3)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go lock.TrySharedWith(func() {
+			wg.Done()
+			<-release
+		})
+	}
+	wg.Wait()
+	if !lock.TrySharedWith(func() {}) {
+		t.Error("shared should be ok")
+	}
+	if lock.TryWith(func() {}) {
+		t.Error("exclusive should fail when shared held")
+	}
+	if lock.TimeoutWith(50*time.Millisecond, func() {}) {
+		t.Error("exclusive should timeout when shared held")
+	}
+	// all permits taken back after failed exclusive
+	if !lock.TrySharedWith(func() {}) {
+		t.Error("shared should be ok after exclusive failed")
+	}
+	close(release)
+	done := make(chan struct{})
+	go lock.With(func() {
+		if lock.TrySharedWith(func() {}) {
+			t.Error("shared should fail when exclusive held")
+		}
+		if lock.TimeoutSharedWith(50*time.Millisecond, func() {}) {
+			t.Error("shared should timeout when exclusive held")
+		}
+		close(done)
+	})
+	<-done
+	if !lock.TimeoutSharedWith(time.Second, func() {}) {
+		t.Error("shared should be ok after exclusive released")
+	}
+}
+
+func TestGetConfLock(t *testing.T) {
+	if l := GetConfLock(&conf.Lock{Name: "test_conf_sem", Permits: 3}); l.kind != "semaphore" || l.permits != 3 {
+		t.Errorf("should be semaphore: %s", l.kind)
+	}
+	if l := GetConfLock(&conf.Lock{Name: "test_conf_rw", Mode: "shared"}); l.kind != "rw" || l.permits != DefaultSharedPermits {
+		t.Errorf("should be rw: %s", l.kind)
+	}
+	if l := GetConfLock(&conf.Lock{Name: "test_conf_mutex"}); l.kind != "mutex" {
+		t.Errorf("should be mutex: %s", l.kind)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go withConfLock(&conf.Lock{Name: "test_conf_rw", Mode: "shared"}, LockOwner{}, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	if locked, _ := withConfLock(&conf.Lock{Name: "test_conf_rw", Mode: "shared"}, LockOwner{}, func() {}); !locked {
+		t.Error("shared should be ok")
+	}
+	if locked, _ := withConfLock(&conf.Lock{Name: "test_conf_rw", Mode: "exclusive"}, LockOwner{}, func() {}); locked {
+		t.Error("exclusive should fail")
+	}
+	close(release)
+}
+
+func TestReloadLocks(t *testing.T) {
+	newConfig := func(permits int) *conf.Config {
+		return &conf.Config{Timers: map[string]*conf.Timer{"t": {Lock: conf.Lock{Name: "test_reload", Permits: permits}}}}
+	}
+	lock := GetConfLock(&conf.Lock{Name: "test_reload", Permits: 2})
+	releaseLock(lock)
+	reloadLocks(newConfig(3))
+	lock = GetConfLock(&conf.Lock{Name: "test_reload", Permits: 3})
+	if lock.kind != "semaphore" || lock.permits != 3 {
+		t.Errorf("idle lock should be changed: %s %d", lock.kind, lock.permits)
+	}
+	reloadLocks(newConfig(1))
+	if l := GetConfLock(&conf.Lock{Name: "test_reload"}); l != lock {
+		t.Errorf("lock in use should be kept")
+	}
+	releaseLock(lock)
+	releaseLock(lock)
+	reloadLocks(newConfig(1))
+	if l := GetConfLock(&conf.Lock{Name: "test_reload"}); l.kind != "mutex" {
+		t.Errorf("lock should be changed after released: %s", l.kind)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"sync"
+)
+
+const ServantNonceHeader = "X-Servant-Nonce"
+
+const defaultMaxNonces = 100000
+
+// nonceCache remembers nonces of signed requests until their timestamps are too old to pass auth,
+// to deny replayed requests. Each user has its own nonces and limit, so a user can not
+// deny others by using up the cache.
+type nonceCache struct {
+	sync.Mutex
+	max   int
+	users map[string]*userNonces
+}
+
+// userNonces are nonces of a user, with a heap of them ordered by expire time to purge expired ones
+type userNonces struct {
+	expires map[string]int64 // nonce -> expire unix timestamp
+	heap    nonceHeap
+}
+
+type nonceEntry struct {
+	nonce  string
+	expire int64
+}
+
+type nonceHeap []nonceEntry
+
+func (self nonceHeap) Len() int           { return len(self) }
+func (self nonceHeap) Less(i, j int) bool { return self[i].expire < self[j].expire }
+func (self nonceHeap) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *nonceHeap) Push(x interface{}) {
+	*self = append(*self, x.(nonceEntry))
+}
+
+func (self *nonceHeap) Pop() interface{} {
+	old := *self
+	ret := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return ret
+}
+
+var nonces = newNonceCache(conf.Auth{})
+
+func newNonceCache(authConf conf.Auth) *nonceCache {
+	ret := &nonceCache{users: make(map[string]*userNonces)}
+	ret.configure(authConf)
+	return ret
+}
+
+func (self *nonceCache) configure(authConf conf.Auth) {
+	self.Lock()
+	defer self.Unlock()
+	self.max = authConf.MaxNonces
+	if self.max <= 0 {
+		self.max = defaultMaxNonces
+	}
+}
+
+// add records the nonce of the user until expire. Fails if the nonce is used and not expired,
+// or the user has too many nonces not expired.
+func (self *nonceCache) add(user, nonce string, expire, now int64) error {
+	self.Lock()
+	defer self.Unlock()
+	un, ok := self.users[user]
+	if !ok {
+		un = &userNonces{expires: make(map[string]int64)}
+		self.users[user] = un
+	}
+	un.purge(now)
+	if _, ok := un.expires[nonce]; ok {
+		return fmt.Errorf("nonce %s is used", nonce)
+	}
+	if len(un.expires) >= self.max {
+		// forgetting nonces not expired would allow replaying
+		return fmt.Errorf("too many nonces of %s", user)
+	}
+	un.expires[nonce] = expire
+	heap.Push(&un.heap, nonceEntry{nonce: nonce, expire: expire})
+	return nil
+}
+
+// purge removes nonces expired, the earliest first
+func (self *userNonces) purge(now int64) {
+	for len(self.heap) > 0 && self.heap[0].expire < now {
+		entry := heap.Pop(&self.heap).(nonceEntry)
+		delete(self.expires, entry.nonce)
+	}
+}
+
+func (self *nonceCache) size() int {
+	self.Lock()
+	defer self.Unlock()
+	ret := 0
+	for _, un := range self.users {
+		ret += len(un.expires)
+	}
+	return ret
+}
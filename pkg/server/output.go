@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxLoggedOutput = 1024
+
+// limitedBuffer keeps at most max bytes and silently drops the rest,
+// so it never blocks or fails the writing process.
+// The buffer is not embedded, as its ReadFrom would bypass the limit in io.Copy.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func newLimitedBuffer(max int) *limitedBuffer {
+	return &limitedBuffer{max: max}
+}
+
+func (self *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if left := self.max - self.buf.Len(); left < n {
+		p = p[:left]
+		self.truncated = true
+	}
+	self.buf.Write(p)
+	return n, nil
+}
+
+func (self *limitedBuffer) Len() int {
+	return self.buf.Len()
+}
+
+func (self *limitedBuffer) String() string {
+	if self.truncated {
+		return self.buf.String() + "..."
+	}
+	return self.buf.String()
+}
+
+func truncateOutput(out []byte, max int) string {
+	if len(out) > max {
+		return string(out[:max]) + "..."
+	}
+	return string(out)
+}
+
+const (
+	OutputDiscard = "discard"
+	OutputFile    = "file"
+	OutputLog     = "log"
+	// stderr only, writes to where stdout goes
+	OutputMerge = "merge"
+)
+
+// size of latest output of daemons and timers kept in memory
+const taskOutputTail = 64 * 1024
+
+const defaultOutputLines = 100
+
+// how long to wait for output after the process exits, as its children may keep the output open
+var taskOutputWaitDelay = 5 * time.Second
+
+// rotatingFile appends to a file, and rotates it to path.1, path.2... when it grows too large.
+// Errors are logged instead of returned, so that a broken log file never breaks the writing process.
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	failed  bool
+	// daemons and timers writing to it, guarded by rotatingFilesLock
+	users int
+}
+
+var rotatingFiles = make(map[string]*rotatingFile)
+var rotatingFilesLock sync.Mutex
+
+// getRotatingFile returns the same writer for the same path, so that daemons and timers can share a file.
+// The file can not be shared with different maxsize or backups. It should be released by release.
+func getRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rotatingFilesLock.Lock()
+	defer rotatingFilesLock.Unlock()
+	ret, ok := rotatingFiles[path]
+	if !ok {
+		ret = &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+		rotatingFiles[path] = ret
+	} else if ret.maxSize != maxSize || ret.backups != backups {
+		return nil, fmt.Errorf("output file %s is used with different maxsize or backups", path)
+	}
+	ret.users++
+	return ret, nil
+}
+
+// release closes the file when no one writes to it
+func (self *rotatingFile) release() {
+	rotatingFilesLock.Lock()
+	defer rotatingFilesLock.Unlock()
+	self.users--
+	if self.users > 0 {
+		return
+	}
+	if rotatingFiles[self.path] == self {
+		delete(rotatingFiles, self.path)
+	}
+	self.Lock()
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+	self.Unlock()
+}
+
+func (self *rotatingFile) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.maxSize > 0 && self.file != nil && self.size > 0 && self.size+int64(len(p)) > self.maxSize {
+		self.rotate()
+	}
+	if self.file == nil && !self.open() {
+		return len(p), nil
+	}
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	if err != nil {
+		self.fail("write %s failed: %s", self.path, err)
+	}
+	return len(p), nil
+}
+
+// open must be called with lock held
+func (self *rotatingFile) open() bool {
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		self.fail("open %s failed: %s", self.path, err)
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		self.fail("stat %s failed: %s", self.path, err)
+		return false
+	}
+	self.file, self.size, self.failed = file, info.Size(), false
+	return true
+}
+
+// rotate must be called with lock held
+func (self *rotatingFile) rotate() {
+	self.file.Close()
+	self.file = nil
+	for i := self.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", self.path, i), fmt.Sprintf("%s.%d", self.path, i+1))
+	}
+	var err error
+	if self.backups > 0 {
+		err = os.Rename(self.path, self.path+".1")
+	} else {
+		err = os.Remove(self.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		self.fail("rotate %s failed: %s", self.path, err)
+	}
+}
+
+// fail logs only the first error until the file works again
+func (self *rotatingFile) fail(format string, v ...interface{}) {
+	if !self.failed {
+		logger.Printf("WARN (_) [output] "+format, v...)
+	}
+	self.failed = true
+}
+
+// logWriter writes output line by line into servant's log
+type logWriter struct {
+	sync.Mutex
+	topic  string
+	prefix string
+	buf    []byte
+}
+
+func (self *logWriter) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	self.buf = append(self.buf, p...)
+	for {
+		i := bytes.IndexByte(self.buf, '\n')
+		if i < 0 {
+			break
+		}
+		self.writeLine(self.buf[:i])
+		self.buf = self.buf[i+1:]
+	}
+	if len(self.buf) >= maxLoggedOutput {
+		self.writeLine(self.buf)
+		self.buf = self.buf[:0]
+	}
+	return len(p), nil
+}
+
+// writeLine must be called with lock held
+func (self *logWriter) writeLine(line []byte) {
+	logger.Printf("INFO (_) [%s] %s: %s", self.topic, self.prefix, line)
+}
+
+// Flush logs the incomplete last line
+func (self *logWriter) Flush() {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.buf) > 0 {
+		self.writeLine(self.buf)
+		self.buf = self.buf[:0]
+	}
+}
+
+// taskOutput sends output of daemons and timers to where it is configured,
+// and keeps the latest output in memory. Output discarded explicitly is not kept,
+// and goes to the null device, so no pipe is needed.
+type taskOutput struct {
+	stdout, stderr io.Writer
+	merged         bool
+	stdoutTail     *outputBuffer
+	stderrTail     *outputBuffer
+	logWriters     []*logWriter
+	files          []*rotatingFile
+}
+
+func newTaskOutput(topic, name string, stdoutConf, stderrConf *conf.Output) (*taskOutput, error) {
+	ret := &taskOutput{
+		stdoutTail: newOutputBuffer(taskOutputTail),
+		stderrTail: newOutputBuffer(taskOutputTail),
+	}
+	stdout, err := ret.newWriter(topic, name+" stdout", stdoutConf)
+	if err != nil {
+		return nil, err
+	}
+	if stdout != nil {
+		ret.stdout = tee(ret.stdoutTail, stdout)
+	}
+	if stderrConf.Type == OutputMerge {
+		ret.merged = true
+		ret.stderr = ret.stdout
+		return ret, nil
+	}
+	stderr, err := ret.newWriter(topic, name+" stderr", stderrConf)
+	if err != nil {
+		ret.close()
+		return nil, err
+	}
+	if stderr != nil {
+		ret.stderr = tee(ret.stderrTail, stderr)
+	}
+	return ret, nil
+}
+
+// tee writes to both capture and w, w is nil when the output is discarded
+func tee(capture, w io.Writer) io.Writer {
+	if w == nil {
+		return capture
+	}
+	return io.MultiWriter(capture, w)
+}
+
+func (self *taskOutput) newWriter(topic, prefix string, outputConf *conf.Output) (io.Writer, error) {
+	switch outputConf.Type {
+	case "":
+		return ioutil.Discard, nil
+	case OutputDiscard:
+		return nil, nil
+	case OutputLog:
+		if outputConf.Prefix != "" {
+			prefix = outputConf.Prefix
+		}
+		ret := &logWriter{topic: topic, prefix: prefix}
+		self.logWriters = append(self.logWriters, ret)
+		return ret, nil
+	case OutputFile:
+		maxSize, err := outputMaxSize(outputConf)
+		if err != nil {
+			return nil, err
+		}
+		file, err := getRotatingFile(outputConf.Path, maxSize, outputConf.Backups)
+		if err != nil {
+			return nil, err
+		}
+		self.files = append(self.files, file)
+		return file, nil
+	default:
+		return nil, fmt.Errorf("unknown output type: %s", outputConf.Type)
+	}
+}
+
+// outputMaxSize checks the path of a file output and parses its max size
+func outputMaxSize(outputConf *conf.Output) (int64, error) {
+	if outputConf.Path == "" {
+		return 0, fmt.Errorf("output file path not set")
+	}
+	if outputConf.MaxSize == "" {
+		return 0, nil
+	}
+	return parseSize(outputConf.MaxSize)
+}
+
+// checkTaskOutput checks the output config as newTaskOutput does, without opening files
+func checkTaskOutput(stdoutConf, stderrConf *conf.Output) error {
+	for _, outputConf := range []*conf.Output{stdoutConf, stderrConf} {
+		switch outputConf.Type {
+		case "", OutputDiscard, OutputLog:
+		case OutputMerge:
+			if outputConf == stdoutConf {
+				return fmt.Errorf("unknown output type: %s", outputConf.Type)
+			}
+		case OutputFile:
+			if _, err := outputMaxSize(outputConf); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown output type: %s", outputConf.Type)
+		}
+	}
+	return nil
+}
+
+// attach sets the output of cmd, and also writes both stdout and stderr to capture if it is not nil
+func (self *taskOutput) attach(cmd *exec.Cmd, capture io.Writer) {
+	cmd.WaitDelay = taskOutputWaitDelay
+	if capture == nil {
+		cmd.Stdout, cmd.Stderr = self.stdout, self.stderr
+		return
+	}
+	cmd.Stdout = tee(capture, self.stdout)
+	if self.merged {
+		cmd.Stderr = cmd.Stdout
+	} else {
+		cmd.Stderr = tee(capture, self.stderr)
+	}
+}
+
+// wait waits for cmd, output still open after taskOutputWaitDelay since the process exits is dropped
+func (self *taskOutput) wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	if err == exec.ErrWaitDelay {
+		logger.Printf("WARN (_) [output] output of %v is still open after exited, the rest is dropped", cmd.Args)
+		return nil
+	}
+	return err
+}
+
+// flush must be called after the process exits
+func (self *taskOutput) flush() {
+	for _, w := range self.logWriters {
+		w.Flush()
+	}
+}
+
+// close releases output files, when the daemon or timer is removed
+func (self *taskOutput) close() {
+	for _, file := range self.files {
+		file.release()
+	}
+	self.files = nil
+}
+
+// lastLines returns the last n lines of data
+func lastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// serveLastLines serves the last lines of output, with ?lines=N, default is 100
+func (self *Session) serveLastLines(output *outputBuffer) {
+	lines := defaultOutputLines
+	if linesStr := self.req.URL.Query().Get("lines"); linesStr != "" {
+		var err error
+		lines, err = strconv.Atoi(linesStr)
+		if err != nil || lines <= 0 {
+			self.ErrorEnd(http.StatusBadRequest, "bad lines: %s", linesStr)
+			return
+		}
+	}
+	data, _, _ := output.Since(0)
+	self.resp.Header().Set("Content-Type", "text/plain")
+	_, err := self.resp.Write(lastLines(data, lines))
+	if err != nil {
+		self.BadEnd("io error: %s", err)
+	} else {
+		self.GoodEnd("output of %s done", self.group)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	file, _ := getRotatingFile(path, 10, 2)
+	if same, _ := getRotatingFile(path, 10, 2); same != file {
+		t.Error("same path should get the same writer")
+	}
+	if _, err := getRotatingFile(path, 20, 2); err == nil {
+		t.Error("same path with different maxsize should fail")
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if n, err := file.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("write failed: %d %v", n, err)
+		}
+	}
+	for name, expected := range map[string]string{"out.log": "dddddd\n", "out.log.1": "cccccc\n", "out.log.2": "bbbbbb\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("%s should be %q, got %q %v", name, expected, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("only 2 backups should be kept")
+	}
+	file.release()
+	file.release()
+	if _, err := getRotatingFile(path, 20, 2); err != nil {
+		t.Errorf("released file should be configured again: %v", err)
+	}
+	// errors never break the writing process
+	bad, _ := getRotatingFile(filepath.Join(dir, "nothing", "out.log"), 0, 0)
+	if n, err := bad.Write([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("write to bad file should not fail: %d %v", n, err)
+	}
+}
+
+func TestNewTaskOutputError(t *testing.T) {
+	if _, err := newTaskOutput("timer", "t", &conf.Output{Type: "bad"}, &conf.Output{}); err == nil {
+		t.Error("bad output type should fail")
+	}
+	if _, err := newTaskOutput("timer", "t", &conf.Output{}, &conf.Output{Type: OutputFile}); err == nil {
+		t.Error("file output without path should fail")
+	}
+	if _, err := newTaskOutput("timer", "t", &conf.Output{Type: OutputFile, Path: "/tmp/x", MaxSize: "bad"}, &conf.Output{}); err == nil {
+		t.Error("bad max size should fail")
+	}
+	path := filepath.Join(os.TempDir(), "servant_output_conflict.log")
+	output, err := newTaskOutput("timer", "t", &conf.Output{Type: OutputFile, Path: path}, &conf.Output{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+	if _, err := newTaskOutput("timer", "t2", &conf.Output{Type: OutputFile, Path: path, Backups: 3}, &conf.Output{}); err == nil {
+		t.Error("same file with different backups should fail")
+	}
+}
+
+func TestTaskOutputDiscard(t *testing.T) {
+	output, err := newTaskOutput("daemon", "d", &conf.Output{Type: OutputDiscard}, &conf.Output{Type: OutputMerge})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("true")
+	output.attach(cmd, nil)
+	if cmd.Stdout != nil || cmd.Stderr != nil {
+		t.Error("discarded output should go to the null device")
+	}
+	output, _ = newTaskOutput("daemon", "d", &conf.Output{}, &conf.Output{})
+	output.attach(cmd, nil)
+	if cmd.Stdout == nil || cmd.Stderr == nil {
+		t.Error("output should be kept in memory")
+	}
+}
+
+func TestTaskOutputWaitDelay(t *testing.T) {
+	defer func(d time.Duration) {
+		taskOutputWaitDelay = d
+	}(taskOutputWaitDelay)
+	taskOutputWaitDelay = 100 * time.Millisecond
+	// the child keeps stdout open after the process exits
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "sleep 10 & echo started"})
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+	if run := timer.History()[0]; run.State != TimerRunExited || run.Output != "started\n" {
+		t.Errorf("run should end when the process exits: %+v", run)
+	}
+}
+
+func TestTaskOutputMerge(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "echo hello; sleep 0.1; echo world >&2", Stderr: conf.Output{Type: OutputMerge}})
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+	if data, _, _ := timer.output.stdoutTail.Since(0); string(data) != "hello\nworld\n" {
+		t.Errorf("stderr should be merged: %q", data)
+	}
+	if data, _, _ := timer.output.stderrTail.Since(0); len(data) != 0 {
+		t.Errorf("stderr should be empty: %q", data)
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	for _, c := range []struct {
+		data     string
+		n        int
+		expected string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 5, "a\nb\nc\n"},
+		{"", 1, ""},
+	} {
+		if ret := string(lastLines([]byte(c.data), c.n)); ret != c.expected {
+			t.Errorf("last %d lines of %q should be %q, got %q", c.n, c.data, c.expected, ret)
+		}
+	}
+}
+
+func TestServeDaemonOutput(t *testing.T) {
+	daemon := newTestDaemon(t, "output_test", &conf.Daemon{Code: "for i in 1 2 3; do echo $i; done; echo err >&2; sleep 10"})
+	daemons.add(daemon)
+	daemon.Start()
+	defer daemon.Stop()
+	serve := func(url, item string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		resp := httptest.NewRecorder()
+		NewDaemonServer(&Session{req: req, resp: resp, resource: "daemons", group: "output_test", item: item}).serve()
+		return resp
+	}
+	var resp *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ {
+		if data, _, _ := daemon.output.stderrTail.Since(0); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp = serve("/daemons/output_test/output?lines=2", "output")
+	if resp.Body.String() != "2\n3\n" || !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("bad output: %q", resp.Body.String())
+	}
+	if resp = serve("/daemons/output_test/stderr", "stderr"); resp.Body.String() != "err\n" {
+		t.Errorf("bad stderr: %q", resp.Body.String())
+	}
+	if resp = serve("/daemons/output_test/output?lines=x", "output"); resp.Code != http.StatusBadRequest {
+		t.Errorf("bad lines should be 400, got %d", resp.Code)
+	}
+}
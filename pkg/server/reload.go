@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ConfigLoader loads config again, in the same way as it is loaded at start
+type ConfigLoader func() (*conf.Config, error)
+
+func (self *Server) SetConfigLoader(loader ConfigLoader) {
+	self.loader = loader
+}
+
+type configChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	// unchanged ones restarted with what they depend on
+	Restarted []string `json:"restarted,omitempty"`
+}
+
+type reloadResult struct {
+	Daemons configChanges `json:"daemons"`
+	Timers  configChanges `json:"timers"`
+}
+
+// diffConfs compares two maps of name to config
+func diffConfs(oldConfs, newConfs interface{}) configChanges {
+	var ret configChanges
+	oldMap, newMap := reflect.ValueOf(oldConfs), reflect.ValueOf(newConfs)
+	for _, key := range newMap.MapKeys() {
+		oldValue := oldMap.MapIndex(key)
+		if !oldValue.IsValid() {
+			ret.Added = append(ret.Added, key.String())
+		} else if !reflect.DeepEqual(oldValue.Interface(), newMap.MapIndex(key).Interface()) {
+			ret.Changed = append(ret.Changed, key.String())
+		}
+	}
+	for _, key := range oldMap.MapKeys() {
+		if !newMap.MapIndex(key).IsValid() {
+			ret.Removed = append(ret.Removed, key.String())
+		}
+	}
+	sort.Strings(ret.Added)
+	sort.Strings(ret.Removed)
+	sort.Strings(ret.Changed)
+	return ret
+}
+
+// Reload loads config again and replaces the current one. Requests already running keep using the old config.
+// Only added, removed or changed daemons and timers are started or stopped.
+// If the new config is invalid, the old config is kept.
+func (self *Server) Reload() (*reloadResult, error) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	ret, err := self.reload()
+	if err != nil {
+		logger.Printf("WARN (_) [server] reload failed: %s", err.Error())
+		return nil, err
+	}
+	logger.Printf("INFO (_) [server] reloaded. daemons: %+v, timers: %+v", ret.Daemons, ret.Timers)
+	return ret, nil
+}
+
+func (self *Server) reload() (*reloadResult, error) {
+	if self.loader == nil {
+		return nil, fmt.Errorf("config loader not set")
+	}
+	if isExiting() {
+		return nil, fmt.Errorf("servant is exiting")
+	}
+	config, err := self.loader()
+	if err != nil {
+		return nil, err
+	}
+	oldConfig := self.getConfig()
+	ret := &reloadResult{
+		Daemons: diffConfs(oldConfig.Daemons, config.Daemons),
+		Timers:  diffConfs(oldConfig.Timers, config.Timers),
+	}
+	// check new daemons and timers before anything is changed
+	for _, name := range append(ret.Daemons.Added, ret.Daemons.Changed...) {
+		if err := checkDaemon(name, config.Daemons[name]); err != nil {
+			return nil, fmt.Errorf("daemon %s: %s", name, err)
+		}
+	}
+	for _, name := range append(ret.Timers.Added, ret.Timers.Changed...) {
+		if err := checkTimer(name, config.Timers[name]); err != nil {
+			return nil, fmt.Errorf("timer %s: %s", name, err)
+		}
+	}
+	// certificates are loaded again
+	if self.tls != nil && config.Server.TLS.Cert != "" {
+		if err := self.tls.load(&config.Server.TLS); err != nil {
+			return nil, err
+		}
+	}
+	oldServer, newServer := oldConfig.Server, config.Server
+	// shutdown timeout is read when shutting down, tls is reloaded above
+	oldServer.ShutdownTimeout = newServer.ShutdownTimeout
+	if (oldServer.TLS.Cert == "") == (newServer.TLS.Cert == "") {
+		oldServer.TLS = newServer.TLS
+	}
+	if oldServer != newServer {
+		logger.Printf("WARN (_) [server] listen address, timeouts or tls enabling changed, restart to apply them")
+	}
+	if config.Log != oldConfig.Log {
+		logger.Printf("WARN (_) [server] log file changed to %s, restart to apply it", config.Log)
+	}
+	self.configLock.Lock()
+	self.config = config
+	self.configLock.Unlock()
+	self.loadVars(oldConfig)
+	jobs.configure(config.Jobs)
+	nonces.configure(config.Auth)
+	reloadLocks(config)
+	reloadTimers(&ret.Timers, config.Timers)
+	reloadDaemons(&ret.Daemons, config.Daemons)
+	return ret, nil
+}
+
+func reloadTimers(changes *configChanges, timerConfs map[string]*conf.Timer) {
+	var wg sync.WaitGroup
+	for _, name := range append(changes.Removed, changes.Changed...) {
+		timer := timers.get(name)
+		if timer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(timer *Timer) {
+			defer wg.Done()
+			timer.Stop(processStopTimeout)
+			timers.remove(timer)
+		}(timer)
+	}
+	wg.Wait()
+	for _, name := range append(changes.Added, changes.Changed...) {
+		go RunTimer(name, timerConfs[name])
+	}
+}
+
+func reloadDaemons(changes *configChanges, daemonConfs map[string]*conf.Daemon) {
+	changes.Restarted = daemonDependents(append(changes.Removed, changes.Changed...), daemons.list())
+	var stopping []*Daemon
+	for _, name := range append(append(changes.Removed, changes.Changed...), changes.Restarted...) {
+		if daemon := daemons.get(name); daemon != nil {
+			stopping = append(stopping, daemon)
+		}
+	}
+	stopDaemonList(stopping)
+	for _, daemon := range stopping {
+		daemons.remove(daemon)
+	}
+	starting := make(map[string]*conf.Daemon)
+	for _, name := range append(append(changes.Added, changes.Changed...), changes.Restarted...) {
+		starting[name] = daemonConfs[name]
+	}
+	startDaemons(starting)
+}
+
+// daemonDependents returns daemons depending on the given ones directly or indirectly, except the given ones.
+// Stopped and failed daemons are left as they are.
+func daemonDependents(names []string, all []*Daemon) []string {
+	found := make(map[string]bool, len(names))
+	for _, name := range names {
+		found[name] = true
+	}
+	var ret []string
+	for more := true; more; {
+		more = false
+		for _, daemon := range all {
+			if found[daemon.name] {
+				continue
+			}
+			for _, dep := range daemon.conf.Depends {
+				if found[dep] {
+					found[daemon.name] = true
+					if state := daemon.Status().State; state != DaemonStopped && state != DaemonFailed {
+						ret = append(ret, daemon.name)
+					}
+					more = true
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+type ReloadServer struct {
+	*Session
+}
+
+func NewReloadServer(sess *Session) Handler {
+	return ReloadServer{
+		Session: sess,
+	}
+}
+
+// POST /reload
+func (self ReloadServer) serve() {
+	if self.req.Method != "POST" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", self.req.Method)
+		return
+	}
+	ret, err := self.server.Reload()
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "reload failed: %s", err)
+		return
+	}
+	self.info("reloaded by %s", self.username)
+	self.JsonEnd(ret)
+}
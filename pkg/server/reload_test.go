@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffConfs(t *testing.T) {
+	oldConfs := map[string]*conf.Timer{"a": {Tick: 1}, "b": {Tick: 1}, "c": {Tick: 1}}
+	newConfs := map[string]*conf.Timer{"a": {Tick: 1}, "b": {Tick: 2}, "d": {Tick: 1}}
+	changes := diffConfs(oldConfs, newConfs)
+	expected := configChanges{Added: []string{"d"}, Removed: []string{"c"}, Changed: []string{"b"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes should be %+v, got %+v", expected, changes)
+	}
+}
+
+func testReloadConfig(daemonCode map[string]string, tick int) *conf.Config {
+	ret := &conf.Config{Daemons: map[string]*conf.Daemon{}, Timers: map[string]*conf.Timer{}}
+	for name, code := range daemonCode {
+		ret.Daemons[name] = &conf.Daemon{Lang: "bash", Code: code, Live: 3600}
+	}
+	ret.Timers["reload_t"] = &conf.Timer{Lang: "bash", Code: "true", Tick: tick}
+	return ret
+}
+
+func TestReload(t *testing.T) {
+	config := testReloadConfig(map[string]string{
+		"reload_keep":   "sleep 10",
+		"reload_change": "sleep 10",
+		"reload_remove": "sleep 10",
+	}, 3600)
+	server := &Server{config: config}
+	if _, err := server.Reload(); err == nil {
+		t.Error("reload without loader should fail")
+	}
+	startDaemons(config.Daemons)
+	go RunTimer("reload_t", config.Timers["reload_t"])
+	for _, name := range []string{"reload_keep", "reload_change", "reload_remove"} {
+		for i := 0; i < 100 && daemons.get(name) == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitDaemonState(t, daemons.get(name), DaemonRunning)
+	}
+	for i := 0; i < 100 && timers.get("reload_t") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	keep, change, remove, timer := daemons.get("reload_keep"), daemons.get("reload_change"), daemons.get("reload_remove"), timers.get("reload_t")
+
+	var loaded *conf.Config
+	var loadErr error
+	server.SetConfigLoader(func() (*conf.Config, error) {
+		return loaded, loadErr
+	})
+	loadErr = fmt.Errorf("bad config")
+	if _, err := server.Reload(); err == nil || server.getConfig() != config {
+		t.Errorf("failed reload should keep the old config: %v", err)
+	}
+	loaded, loadErr = testReloadConfig(map[string]string{"reload_keep": "sleep 10", "reload_change": "sleep 10"}, 3600), nil
+	loaded.Daemons["reload_change"].Restart = "sometimes"
+	if _, err := server.Reload(); err == nil || server.getConfig() != config || daemons.get("reload_remove") != remove {
+		t.Errorf("invalid daemon should keep the old config: %v", err)
+	}
+
+	loaded = testReloadConfig(map[string]string{
+		"reload_keep":   "sleep 10",
+		"reload_change": "sleep 11",
+		"reload_add":    "sleep 10",
+	}, 1800)
+	ret, err := server.Reload()
+	if err != nil {
+		t.Fatalf("reload failed: %s", err)
+	}
+	if server.getConfig() != loaded {
+		t.Error("config should be replaced")
+	}
+	expected := reloadResult{
+		Daemons: configChanges{Added: []string{"reload_add"}, Removed: []string{"reload_remove"}, Changed: []string{"reload_change"}},
+		Timers:  configChanges{Changed: []string{"reload_t"}},
+	}
+	if !reflect.DeepEqual(*ret, expected) {
+		t.Errorf("result should be %+v, got %+v", expected, *ret)
+	}
+	if daemons.get("reload_keep") != keep || keep.Status().State != DaemonRunning || keep.Status().Restarts != 0 {
+		t.Errorf("unchanged daemon should not be restarted: %+v", keep.Status())
+	}
+	if daemons.get("reload_remove") != nil || remove.Status().State != DaemonStopped {
+		t.Errorf("removed daemon should be stopped: %+v", remove.Status())
+	}
+	if change.Status().State != DaemonStopped {
+		t.Errorf("changed daemon should be stopped: %+v", change.Status())
+	}
+	for _, name := range []string{"reload_change", "reload_add"} {
+		for i := 0; i < 100 && daemons.get(name) == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if daemon := daemons.get(name); daemon == nil || daemon == change {
+			t.Errorf("daemon %s should be started", name)
+		} else {
+			waitDaemonState(t, daemon, DaemonRunning)
+			daemon.Stop()
+		}
+	}
+	keep.Stop()
+	for i := 0; i < 100 && timers.get("reload_t") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if newTimer := timers.get("reload_t"); newTimer == nil || newTimer == timer || newTimer.conf.Tick != 1800 {
+		t.Error("changed timer should be replaced")
+	} else {
+		newTimer.Stop(time.Second)
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	config := testReloadConfig(nil, 3600)
+	server := &Server{config: config}
+	server.SetConfigLoader(func() (*conf.Config, error) {
+		return config, nil
+	})
+	serve := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/reload", nil)
+		resp := httptest.NewRecorder()
+		NewReloadServer(&Session{server: server, req: req, resp: resp, resource: "reload"}).serve()
+		return resp
+	}
+	if resp := serve("GET"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("reload should be POST only, got %d", resp.Code)
+	}
+	resp := serve("POST")
+	var ret reloadResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &ret); err != nil || resp.Code != http.StatusOK {
+		t.Errorf("bad reload result: %d %s", resp.Code, resp.Body.String())
+	}
+	server.SetConfigLoader(func() (*conf.Config, error) {
+		return nil, fmt.Errorf("bad config")
+	})
+	if resp = serve("POST"); resp.Code != http.StatusInternalServerError || resp.Header().Get(ServantErrHeader) == "" {
+		t.Errorf("failed reload should be reported, got %d", resp.Code)
+	}
+}
+
+func TestReloadDependents(t *testing.T) {
+	config := testReloadConfig(map[string]string{
+		"dep_a": "sleep 10",
+		"dep_b": "sleep 10",
+		"dep_c": "sleep 10",
+		"dep_d": "sleep 10",
+	}, 3600)
+	config.Daemons["dep_b"].Depends = []string{"dep_a"}
+	config.Daemons["dep_c"].Depends = []string{"dep_b"}
+	startDaemons(config.Daemons)
+	old := make(map[string]*Daemon)
+	for _, name := range []string{"dep_a", "dep_b", "dep_c", "dep_d"} {
+		for i := 0; i < 500 && daemons.get(name) == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitDaemonState(t, daemons.get(name), DaemonRunning)
+		old[name] = daemons.get(name)
+	}
+	newConfs := make(map[string]*conf.Daemon)
+	for name, daemonConf := range config.Daemons {
+		c := *daemonConf
+		newConfs[name] = &c
+	}
+	newConfs["dep_a"].Code = "sleep 11"
+	changes := configChanges{Changed: []string{"dep_a"}}
+	reloadDaemons(&changes, newConfs)
+	if !reflect.DeepEqual(changes.Restarted, []string{"dep_b", "dep_c"}) {
+		t.Errorf("dependents should be restarted: %v", changes.Restarted)
+	}
+	for _, name := range []string{"dep_a", "dep_b", "dep_c", "dep_d"} {
+		for i := 0; i < 500 && daemons.get(name) == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		daemon := daemons.get(name)
+		if daemon == nil {
+			t.Errorf("daemon %s should be running", name)
+			continue
+		}
+		if (daemon == old[name]) != (name == "dep_d") {
+			t.Errorf("only dep_d should be kept: %s", name)
+		}
+		waitDaemonState(t, daemon, DaemonRunning)
+	}
+	for _, name := range []string{"dep_c", "dep_b", "dep_a", "dep_d"} {
+		if daemon := daemons.get(name); daemon != nil {
+			daemon.Stop()
+		}
+	}
+}
+
+func TestReloadOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	newConfig := func(maxSize string) *conf.Config {
+		ret := &conf.Config{Daemons: map[string]*conf.Daemon{}, Timers: map[string]*conf.Timer{}}
+		ret.Timers["reload_out"] = &conf.Timer{Lang: "bash", Code: "true", Tick: 3600,
+			Stdout: conf.Output{Type: OutputFile, Path: path, MaxSize: maxSize}}
+		return ret
+	}
+	config := newConfig("")
+	server := &Server{config: config}
+	go RunTimer("reload_out", config.Timers["reload_out"])
+	for i := 0; i < 100 && timers.get("reload_out") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	old := timers.get("reload_out")
+	loaded := newConfig("1M")
+	server.SetConfigLoader(func() (*conf.Config, error) {
+		return loaded, nil
+	})
+	if _, err := server.Reload(); err != nil {
+		t.Fatalf("changing max size of the output should be ok: %s", err)
+	}
+	for i := 0; i < 100 && (timers.get("reload_out") == nil || timers.get("reload_out") == old); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rotatingFilesLock.Lock()
+	file := rotatingFiles[path]
+	ok := file != nil && file.users == 1 && file.maxSize == 1<<20
+	rotatingFilesLock.Unlock()
+	if !ok {
+		t.Error("output file should be used by the new timer only")
+	}
+	if timer := timers.get("reload_out"); timer != nil {
+		timer.Stop(time.Second)
+		timers.remove(timer)
+	}
+}
@@ -1,26 +1,47 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/xiezhenye/servant/pkg/conf"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const ServantErrHeader = "X-Servant-Err"
+const ServantExitCodeHeader = "X-Servant-Exit-Code"
+const ServantSignalHeader = "X-Servant-Signal"
+
+const defaultShutdownTimeout = 30
 
 type Server struct {
+	// config is replaced on reload, use getConfig
 	config        *conf.Config
+	configLock    sync.RWMutex
+	loader        ConfigLoader
+	reloadLock    sync.Mutex
 	resources     map[string]HandlerFactory
 	nextSessionId uint64
+	httpServer    *http.Server
+	tls           *tlsLoader
+	shutdownOnce  sync.Once
+	// closed when shutdown is done
+	shutdownDone chan struct{}
 }
 
 type Session struct {
-	id                          uint64
+	id     uint64
+	server *Server
+	// config when the request comes, not changed by reload
 	config                      *conf.Config
 	resource, group, item, tail string
 	username                    string
@@ -50,8 +71,11 @@ func NewServer(config *conf.Config) *Server {
 		config:        config,
 		nextSessionId: 0,
 		resources:     make(map[string]HandlerFactory),
+		shutdownDone:  make(chan struct{}),
 	}
-	ret.loadVars()
+	ret.loadVars(nil)
+	jobs.configure(config.Jobs)
+	nonces.configure(config.Auth)
 	if config.Log != "" {
 		file, err := os.OpenFile(config.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0664)
 		if err == nil {
@@ -64,12 +88,30 @@ func NewServer(config *conf.Config) *Server {
 	ret.resources["files"] = NewFileServer
 	ret.resources["databases"] = NewDatabaseServer
 	ret.resources["vars"] = NewVarServer
+	ret.resources["jobs"] = NewJobServer
+	ret.resources["locks"] = NewLockServer
+	ret.resources["timers"] = NewTimerServer
+	ret.resources["daemons"] = NewDaemonServer
+	ret.resources["reload"] = NewReloadServer
 	return ret
 }
 
-func (self *Server) loadVars() {
-	for vgn, vg := range self.config.Vars {
+func (self *Server) getConfig() *conf.Config {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return self.config
+}
+
+// loadVars sets vars in config as global params. Vars not changed since old config are kept,
+// as they may be changed by clients.
+func (self *Server) loadVars(old *conf.Config) {
+	for vgn, vg := range self.getConfig().Vars {
 		for vin, vi := range vg.Vars {
+			if old != nil && old.Vars[vgn] != nil {
+				if oldVar := old.Vars[vgn].Vars[vin]; oldVar != nil && reflect.DeepEqual(oldVar, vi) {
+					continue
+				}
+			}
 			globalKey := vgn + "." + vin
 			SetGlobalParam(globalKey, vi.Value)
 			if vi.Expand {
@@ -83,7 +125,8 @@ func (self *Server) newSession(resp http.ResponseWriter, req *http.Request) *Ses
 	resource, group, item, tail := parseUriPath(req.URL.Path)
 	sess := Session{
 		id:       atomic.AddUint64(&(self.nextSessionId), 1),
-		config:   self.config,
+		server:   self,
+		config:   self.getConfig(),
 		req:      req,
 		resp:     resp,
 		resource: resource,
@@ -95,10 +138,15 @@ func (self *Server) newSession(resp http.ResponseWriter, req *http.Request) *Ses
 }
 
 var uriRe, _ = regexp.Compile(`^/([a-zA-Z]\w*)/([a-zA-Z]\w*)/([a-zA-Z]\w*)((?:/.*)?)$`)
+var resourceUriRe, _ = regexp.Compile(`^/([a-zA-Z]\w*)/?$`)
 
 func parseUriPath(path string) (resource, group, item, tail string) {
 	m := uriRe.FindStringSubmatch(path)
 	if len(m) != 5 {
+		// resources like /locks
+		if m = resourceUriRe.FindStringSubmatch(path); len(m) == 2 {
+			return m[1], "", "", ""
+		}
 		return "", "", "", ""
 	}
 	resource, group, item, tail = m[1], m[2], m[3], m[4]
@@ -159,7 +207,8 @@ func globalParam() func(string) string {
 }
 
 func (self *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
+	// body may be replaced when verified
+	defer func() { req.Body.Close() }()
 	sess := self.newSession(resp, req)
 	sess.info("+ %s %s %s", req.RemoteAddr, req.Method, req.URL.String())
 	username, err := sess.auth()
@@ -168,8 +217,8 @@ func (self *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	sess.username = username
-	if !sess.checkPermission() {
-		sess.ErrorEnd(http.StatusForbidden, "access of %s forbidden", req.URL.Path)
+	if err := sess.checkPermission(); err != nil {
+		sess.ErrorEnd(http.StatusForbidden, "access of %s forbidden: %s", req.URL.Path, err)
 		return
 	}
 	handlerFactory, ok := self.resources[sess.resource]
@@ -193,6 +242,21 @@ func (self *Session) ErrorEnd(code int, format string, v ...interface{}) {
 	self.resp.WriteHeader(code)
 }
 
+func (self *Session) JsonEnd(v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "json marshal failed: %s", err)
+		return
+	}
+	self.resp.Header().Set("Content-Type", "application/json")
+	_, err = self.resp.Write(buf)
+	if err != nil {
+		self.BadEnd("io error: %s", err)
+	} else {
+		self.GoodEnd("%s %s done", self.req.Method, self.req.URL.Path)
+	}
+}
+
 func (self *Session) BadEnd(format string, v ...interface{}) {
 	self.warn("- "+format, v...)
 }
@@ -207,27 +271,80 @@ func (self *Session) UserConfig() *conf.User {
 }
 
 func (self *Server) StartDaemons() {
-	for name, conf := range self.config.Daemons {
-		go RunDaemon(name, conf)
-	}
+	startDaemons(self.getConfig().Daemons)
 }
 
 func (self *Server) StartTimers() {
-	for name, conf := range self.config.Timers {
+	for name, conf := range self.getConfig().Timers {
 		go RunTimer(name, conf)
 	}
 }
 
 func (self *Server) Run() error {
-	s := &http.Server{
-		Addr:           self.config.Server.Listen,
-		Handler:        self,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 8192,
+	serverConf := &self.getConfig().Server
+	s := newHttpServer(serverConf, self)
+	if serverConf.TLS.Cert != "" {
+		self.tls = &tlsLoader{}
+		if err := self.tls.load(&serverConf.TLS); err != nil {
+			return err
+		}
+		s.TLSConfig = self.tls.serverConfig()
 	}
+	self.httpServer = s
+	self.handleSignals()
 	self.StartDaemons()
 	self.StartTimers()
-	logger.Printf("INFO (_) [server] starting listen at %s", s.Addr)
-	return s.ListenAndServe()
+	var err error
+	if self.tls != nil {
+		logger.Printf("INFO (_) [server] starting listen at %s with tls", s.Addr)
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		logger.Printf("INFO (_) [server] starting listen at %s", s.Addr)
+		err = s.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-self.shutdownDone
+		return nil
+	}
+	return err
+}
+
+func (self *Server) handleSignals() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range sigChan {
+			logger.Printf("INFO (_) [server] got signal %s", sig.String())
+			if sig == syscall.SIGHUP {
+				// errors are logged in Reload
+				self.Reload()
+				continue
+			}
+			self.Shutdown()
+			return
+		}
+	}()
+}
+
+// Shutdown stops accepting connections, waits for running requests in the grace period,
+// then terminates running commands, stops timers and daemons.
+func (self *Server) Shutdown() {
+	self.shutdownOnce.Do(func() {
+		setExiting()
+		timeout := self.getConfig().Server.ShutdownTimeout
+		if timeout == 0 {
+			timeout = defaultShutdownTimeout
+		}
+		if self.httpServer != nil {
+			logger.Printf("INFO (_) [server] shutting down, waiting for running requests in %ds", timeout)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+			if err := self.httpServer.Shutdown(ctx); err != nil {
+				logger.Printf("WARN (_) [server] running requests not finished: %s", err.Error())
+			}
+			cancel()
+		}
+		cleanupProcesses()
+		logger.Println("INFO (_) [server] shutdown done")
+		close(self.shutdownDone)
+	})
 }
@@ -25,4 +25,12 @@ func TestParseUriPath(t *testing.T) {
 	if r != "" || g != "" || i != "" || l != "" {
 		t.Fail()
 	}
+	r, g, i, l = parseUriPath("/aaa")
+	if r != "aaa" || g != "" || i != "" || l != "" {
+		t.Fail()
+	}
+	r, g, i, l = parseUriPath("/aaa/")
+	if r != "aaa" || g != "" || i != "" || l != "" {
+		t.Fail()
+	}
 }
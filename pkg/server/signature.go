@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ Authorization: SERVANT-HMAC-SHA256 User=<user>, Timestamp=<ts>, SignedHeaders=<name1;name2>, Signature=<signature>
+ X-Servant-Content-SHA256: hex(sha256(body))
+ X-Servant-Nonce: <nonce>, optional, a nonce can be used only once in maxTimeDelta
+
+ signature = hex(hmac-sha256(key, string to sign)), string to sign is lines joined by "\n":
+
+  SERVANT-HMAC-SHA256
+  <user>
+  <ts>
+  <nonce>, empty without nonce
+  <method>
+  <uri>
+  <lowercase name1>:<trimmed value1>
+  <lowercase name2>:<trimmed value2>
+  <body digest>
+*/
+
+const HmacAuthScheme = "SERVANT-HMAC-SHA256"
+const ServantContentSha256Header = "X-Servant-Content-SHA256"
+
+// bodies larger than it are kept in a temp file while their digest is checked
+const maxMemoryBody = 1 << 20
+
+type hmacAuth struct {
+	user          string
+	ts            int64
+	signedHeaders []string
+	signature     string
+}
+
+func isHmacAuthHeader(authStr string) bool {
+	return strings.HasPrefix(authStr, HmacAuthScheme+" ")
+}
+
+func parseHmacAuthHeader(authStr string) (ret hmacAuth, err error) {
+	if !isHmacAuthHeader(authStr) {
+		err = fmt.Errorf("bad auth header")
+		return
+	}
+	hasTs := false
+	for _, field := range strings.Split(authStr[len(HmacAuthScheme)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("bad auth header field: %s", field)
+			return
+		}
+		switch kv[0] {
+		case "User":
+			ret.user = kv[1]
+		case "Timestamp":
+			ret.ts, err = strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return
+			}
+			hasTs = true
+		case "SignedHeaders":
+			for _, name := range strings.Split(kv[1], ";") {
+				if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+					ret.signedHeaders = append(ret.signedHeaders, name)
+				}
+			}
+		case "Signature":
+			ret.signature = strings.ToLower(kv[1])
+		default:
+			err = fmt.Errorf("unknown auth header field: %s", kv[0])
+			return
+		}
+	}
+	if ret.user == "" || !hasTs || ret.signature == "" {
+		err = fmt.Errorf("bad auth header")
+	}
+	return
+}
+
+func headerValue(req *http.Request, name string) string {
+	if name == "host" {
+		return req.Host
+	}
+	return strings.TrimSpace(strings.Join(req.Header.Values(name), ","))
+}
+
+func hmacStringToSign(req *http.Request, auth *hmacAuth, bodyDigest string) string {
+	lines := []string{HmacAuthScheme, auth.user, strconv.FormatInt(auth.ts, 10),
+		req.Header.Get(ServantNonceHeader), req.Method, req.RequestURI}
+	for _, name := range auth.signedHeaders {
+		lines = append(lines, name+":"+headerValue(req, name))
+	}
+	lines = append(lines, bodyDigest)
+	return strings.Join(lines, "\n")
+}
+
+func hmacSignature(key, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkHmacSignature checks the signature and the nonce, then the body against the signed digest
+func (self *Session) checkHmacSignature(auth *hmacAuth, key string, now int64) error {
+	bodyDigest := strings.ToLower(strings.TrimSpace(self.req.Header.Get(ServantContentSha256Header)))
+	if bodyDigest == "" {
+		return fmt.Errorf("%s header missing", ServantContentSha256Header)
+	}
+	expected := hmacSignature(key, hmacStringToSign(self.req, auth, bodyDigest))
+	if !hmac.Equal([]byte(expected), []byte(auth.signature)) {
+		return fmt.Errorf("auth failed")
+	}
+	if nonce := self.req.Header.Get(ServantNonceHeader); nonce != "" {
+		// requests with the timestamp are denied after it anyway
+		expire := auth.ts + int64(self.config.Auth.MaxTimeDelta)
+		if err := nonces.add(auth.user, nonce, expire, now); err != nil {
+			return err
+		}
+	}
+	return self.verifyBody(bodyDigest)
+}
+
+// verifyBody reads the whole body and checks its digest before anything uses it,
+// then the body is replaced by the read one
+func (self *Session) verifyBody(digest string) error {
+	h := sha256.New()
+	r := io.TeeReader(self.newDeadlineReader(), h)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, maxMemoryBody+1))
+	if err != nil {
+		return fmt.Errorf("read body failed: %s", err)
+	}
+	var body io.ReadCloser = ioutil.NopCloser(&buf)
+	if n > maxMemoryBody {
+		file, err := ioutil.TempFile("", "servant-body")
+		if err != nil {
+			return err
+		}
+		// removed at once, and the space is freed when closed
+		os.Remove(file.Name())
+		body = file
+		if _, err = buf.WriteTo(file); err == nil {
+			if _, err = io.Copy(file, r); err == nil {
+				_, err = file.Seek(0, io.SeekStart)
+			}
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("read body failed: %s", err)
+		}
+	}
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		body.Close()
+		return fmt.Errorf("body digest mismatch")
+	}
+	self.req.Body = body
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startTestProcess(t *testing.T, code string) (*exec.Cmd, chan struct{}) {
+	cmd := exec.Command("bash", "-c", code)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+	registerProcess(cmd)
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		unregisterProcess(cmd)
+		close(exited)
+	}()
+	return cmd, exited
+}
+
+func TestTerminateProcesses(t *testing.T) {
+	cmd1, exited1 := startTestProcess(t, "sleep 10")
+	cmd2, exited2 := startTestProcess(t, "trap '' TERM; sleep 10 & wait")
+	time.Sleep(100 * time.Millisecond) // wait for trap
+	t0 := time.Now()
+	terminateProcesses(time.Second)
+	<-exited1
+	<-exited2
+	if d := time.Since(t0); d < time.Second || d > 3*time.Second {
+		t.Errorf("process should be killed after timeout, got %s", d)
+	}
+	if status := cmd1.ProcessState.Sys().(syscall.WaitStatus); status.Signal() != syscall.SIGTERM {
+		t.Errorf("process should be terminated: %s", cmd1.ProcessState)
+	}
+	if status := cmd2.ProcessState.Sys().(syscall.WaitStatus); status.Signal() != syscall.SIGKILL {
+		t.Errorf("process should be killed: %s", cmd2.ProcessState)
+	}
+	if pids := taskPids(); len(pids) != 0 {
+		t.Errorf("processes should be unregistered: %v", pids)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	defer func() {
+		taskProcessesLock.Lock()
+		_isExiting = false
+		taskProcessesLock.Unlock()
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &Server{
+		config:       &conf.Config{Server: conf.Server{ShutdownTimeout: 5}},
+		shutdownDone: make(chan struct{}),
+	}
+	server.httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	go server.httpServer.Serve(listener)
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	server.Shutdown()
+	if err := <-result; err != nil {
+		t.Errorf("running request should be finished: %s", err)
+	}
+	if !isExiting() {
+		t.Error("should be exiting")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Error("new connections should be refused")
+	}
+	select {
+	case <-server.shutdownDone:
+	default:
+		t.Error("shutdown should be done")
+	}
+}
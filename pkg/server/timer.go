@@ -0,0 +1,606 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	TimerOverlapSkip       = "skip"
+	TimerOverlapQueue      = "queue"
+	TimerOverlapConcurrent = "allow-concurrent"
+	TimerOverlapKill       = "kill-previous"
+)
+
+const (
+	TimerRunRunning = "running"
+	TimerRunExited  = "exited"
+	TimerRunKilled  = "killed"
+	TimerRunTimeout = "timeout"
+	TimerRunFailed  = "failed"
+	TimerRunSkipped = "skipped"
+)
+
+const defaultTimerHistory = 10
+
+// timerRun is an execution of a timer command
+type timerRun struct {
+	Id       uint64    `json:"id"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	State    string    `json:"state"`
+	Pid      int       `json:"pid,omitempty"`
+	ExitCode int       `json:"exit_code"`
+	Signal   int       `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Output   string    `json:"output"`
+	Manual   bool      `json:"manual,omitempty"`
+}
+
+type timerStatus struct {
+	Name    string    `json:"name"`
+	Cron    string    `json:"cron,omitempty"`
+	Tick    int       `json:"tick,omitempty"`
+	Overlap string    `json:"overlap"`
+	Next    time.Time `json:"next"`
+	Running int       `json:"running"`
+	Queued  bool      `json:"queued"`
+	Paused  bool      `json:"paused"`
+	Runs    uint64    `json:"runs"`
+	Last    *timerRun `json:"last,omitempty"`
+}
+
+type Timer struct {
+	sync.Mutex
+	name     string
+	conf     *conf.Timer
+	cmdConf  conf.Command
+	lockConf conf.Lock
+	schedule func(time.Time) time.Time
+	next     time.Time
+	running  map[uint64]*timerRun
+	queued   bool
+	// whether any of the merged queued runs is triggered manually
+	queuedManual bool
+	paused       bool
+	history      []*timerRun
+	maxRuns      int
+	nextRunId    uint64
+	output       *taskOutput
+	stopped      bool
+	// closed when stopped
+	stop chan struct{}
+}
+
+type timerTable struct {
+	sync.Mutex
+	timers map[string]*Timer
+}
+
+var timers = &timerTable{timers: make(map[string]*Timer)}
+
+func (self *timerTable) add(timer *Timer) {
+	self.Lock()
+	self.timers[timer.name] = timer
+	self.Unlock()
+}
+
+// remove removes the timer if it is not replaced
+func (self *timerTable) remove(timer *Timer) {
+	self.Lock()
+	if self.timers[timer.name] == timer {
+		delete(self.timers, timer.name)
+		timer.output.close()
+	}
+	self.Unlock()
+}
+
+func (self *timerTable) get(name string) *Timer {
+	self.Lock()
+	defer self.Unlock()
+	return self.timers[name]
+}
+
+func (self *timerTable) list() []*Timer {
+	self.Lock()
+	defer self.Unlock()
+	ret := make([]*Timer, 0, len(self.timers))
+	for _, timer := range self.timers {
+		ret = append(ret, timer)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterRandLock sync.Mutex
+
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	jitterRandLock.Lock()
+	defer jitterRandLock.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// timerSchedule returns a function which gives the next run time after the given time
+func timerSchedule(timerConf *conf.Timer) (func(time.Time) time.Time, error) {
+	if timerConf.Cron != "" {
+		cron, err := ParseCron(timerConf.Cron, timerConf.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		return cron.Next, nil
+	}
+	if timerConf.Tick <= 0 {
+		return nil, fmt.Errorf("tick or cron not set")
+	}
+	// ticks are measured from start up, missed ticks are dropped
+	start := time.Now()
+	interval := time.Duration(timerConf.Tick) * time.Second
+	return func(t time.Time) time.Time {
+		return start.Add((t.Sub(start)/interval + 1) * interval)
+	}, nil
+}
+
+func NewTimer(name string, timerConf *conf.Timer) (*Timer, error) {
+	ret, err := newTimer(name, timerConf)
+	if err != nil {
+		return nil, err
+	}
+	if ret.output, err = newTaskOutput("timer", name, &timerConf.Stdout, &timerConf.Stderr); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// checkTimer checks the config as NewTimer does, without opening output files
+func checkTimer(name string, timerConf *conf.Timer) error {
+	if _, err := newTimer(name, timerConf); err != nil {
+		return err
+	}
+	return checkTaskOutput(&timerConf.Stdout, &timerConf.Stderr)
+}
+
+// newTimer creates the timer without output
+func newTimer(name string, timerConf *conf.Timer) (*Timer, error) {
+	schedule, err := timerSchedule(timerConf)
+	if err != nil {
+		return nil, err
+	}
+	switch timerConf.Overlap {
+	case "":
+		timerConf.Overlap = TimerOverlapSkip
+	case TimerOverlapSkip, TimerOverlapQueue, TimerOverlapConcurrent, TimerOverlapKill:
+	default:
+		return nil, fmt.Errorf("unknown overlap policy: %s", timerConf.Overlap)
+	}
+	lockConf, err := expandLockConf(timerConf.Lock, requestParams(nil))
+	if err != nil {
+		return nil, err
+	}
+	ret := &Timer{
+		name: name,
+		conf: timerConf,
+		cmdConf: conf.Command{
+			Lang:       timerConf.Lang,
+			Code:       timerConf.Code,
+			User:       timerConf.User,
+			Background: true,
+			Timeout:    timerConf.Deadline,
+			Env:        timerConf.Env,
+			Workdir:    timerConf.Workdir,
+			CleanEnv:   timerConf.CleanEnv,
+			Limits:     timerConf.Limits,
+		},
+		lockConf: lockConf,
+		schedule: schedule,
+		running:  make(map[uint64]*timerRun),
+		maxRuns:  timerConf.History,
+		stop:     make(chan struct{}),
+	}
+	if ret.maxRuns <= 0 {
+		ret.maxRuns = defaultTimerHistory
+	}
+	ret.history = make([]*timerRun, 0, ret.maxRuns)
+	return ret, nil
+}
+
+func RunTimer(name string, timerConf *conf.Timer) {
+	timer, err := NewTimer(name, timerConf)
+	if err != nil {
+		logger.Printf("WARN (_) [timer] %s %s", name, err.Error())
+		return
+	}
+	timers.add(timer)
+	timer.run()
+}
+
+func (self *Timer) run() {
+	logger.Printf("INFO (_) [timer] starting timer %s", self.name)
+	jitter := time.Duration(self.conf.Jitter) * time.Second
+	for {
+		now := time.Now()
+		next := self.schedule(now)
+		if next.IsZero() {
+			logger.Printf("WARN (_) [timer] %s has no next run", self.name)
+			break
+		}
+		self.Lock()
+		self.next = next
+		self.Unlock()
+		if self.conf.Cron != "" {
+			logger.Printf("INFO (_) [timer] %s next run at %s", self.name, next.Format(time.RFC3339))
+		}
+		select {
+		case <-time.After(next.Sub(now) + randomJitter(jitter)):
+		case <-self.stop:
+			logger.Printf("INFO (_) [timer] timer %s stopped", self.name)
+			return
+		}
+		if isExiting() {
+			break
+		}
+		if self.Paused() {
+			logger.Printf("INFO (_) [timer] %s paused, run skipped", self.name)
+			continue
+		}
+		self.fire(false)
+	}
+}
+
+func (self *Timer) Paused() bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.paused
+}
+
+// Pause stops scheduled runs, running ones and manual triggers are not affected.
+func (self *Timer) Pause() {
+	self.Lock()
+	self.paused = true
+	self.Unlock()
+}
+
+func (self *Timer) Resume() {
+	self.Lock()
+	self.paused = false
+	self.Unlock()
+}
+
+// Stop stops scheduling and terminates running runs, kills them if they do not exit in timeout.
+// A stopped timer can not be started again.
+func (self *Timer) Stop(timeout time.Duration) {
+	self.Lock()
+	if !self.stopped {
+		self.stopped = true
+		close(self.stop)
+	}
+	self.queued = false
+	self.queuedManual = false
+	pids := self.runningPids()
+	self.Unlock()
+	for _, pid := range pids {
+		logger.Printf("INFO (_) [timer] %s terminating run. pid: %d", self.name, pid)
+		syscall.Kill(-pid, syscall.SIGTERM)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		self.Lock()
+		idle := len(self.running) == 0
+		pids = self.runningPids()
+		self.Unlock()
+		if idle {
+			return
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, pid := range pids {
+		logger.Printf("WARN (_) [timer] %s killing run. pid: %d", self.name, pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
+
+// runningPids must be called with lock held
+func (self *Timer) runningPids() []int {
+	ret := make([]int, 0, len(self.running))
+	for _, run := range self.running {
+		if run.Pid > 0 {
+			ret = append(ret, run.Pid)
+		}
+	}
+	return ret
+}
+
+// stopTimers stops all timers at the same time
+func stopTimers(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, timer := range timers.list() {
+		wg.Add(1)
+		go func(timer *Timer) {
+			defer wg.Done()
+			timer.Stop(timeout)
+		}(timer)
+	}
+	wg.Wait()
+}
+
+// fire starts a run, or handles it by the overlap policy when previous runs are still running
+func (self *Timer) fire(manual bool) {
+	self.Lock()
+	defer self.Unlock()
+	if self.stopped {
+		logger.Printf("INFO (_) [timer] %s is stopped, run skipped", self.name)
+		return
+	}
+	if len(self.running) > 0 {
+		switch self.conf.Overlap {
+		case TimerOverlapConcurrent:
+		case TimerOverlapQueue:
+			// at most one run is queued
+			self.queued = true
+			self.queuedManual = self.queuedManual || manual
+			logger.Printf("INFO (_) [timer] %s queued: previous run is still running", self.name)
+			return
+		case TimerOverlapKill:
+			for _, run := range self.running {
+				if run.Pid > 0 {
+					logger.Printf("INFO (_) [timer] %s killing previous run %d. pid: %d", self.name, run.Id, run.Pid)
+					syscall.Kill(-run.Pid, syscall.SIGKILL)
+				}
+			}
+			// started when the killed ones end
+			self.queued = true
+			self.queuedManual = self.queuedManual || manual
+			return
+		default:
+			self.nextRunId++
+			self.addHistory(&timerRun{
+				Id:     self.nextRunId,
+				Start:  time.Now(),
+				State:  TimerRunSkipped,
+				Error:  "previous run is still running",
+				Manual: manual,
+			})
+			logger.Printf("WARN (_) [timer] %s skipped: previous run is still running", self.name)
+			return
+		}
+	}
+	self.start(manual)
+}
+
+// start starts a new run. Must be called with lock held.
+func (self *Timer) start(manual bool) {
+	self.nextRunId++
+	run := &timerRun{
+		Id:     self.nextRunId,
+		Start:  time.Now(),
+		State:  TimerRunRunning,
+		Manual: manual,
+	}
+	self.addHistory(run)
+	self.running[run.Id] = run
+	go self.execute(run)
+}
+
+// addHistory puts a run into the ring of recent runs. Must be called with lock held.
+func (self *Timer) addHistory(run *timerRun) {
+	if len(self.history) < self.maxRuns {
+		self.history = append(self.history, run)
+		return
+	}
+	copy(self.history, self.history[1:])
+	self.history[len(self.history)-1] = run
+}
+
+func (self *Timer) execute(run *timerRun) {
+	owner := LockOwner{Command: "timer:" + self.name}
+	locked, err := withConfLock(&self.lockConf, owner, func() {
+		self.runCommand(run)
+	})
+	self.Lock()
+	defer self.Unlock()
+	if err != nil {
+		run.State = TimerRunSkipped
+		run.Error = fmt.Sprintf("lock %s not acquired: %s", self.lockConf.Name, err)
+		logger.Printf("WARN (_) [timer] %s skipped: lock %s not acquired: %s", self.name, self.lockConf.Name, err)
+	} else if !locked {
+		run.State = TimerRunSkipped
+		run.Error = fmt.Sprintf("lock %s not acquired", self.lockConf.Name)
+		logger.Printf("WARN (_) [timer] %s skipped: lock %s not acquired", self.name, self.lockConf.Name)
+	}
+	run.Duration = time.Since(run.Start).Seconds()
+	delete(self.running, run.Id)
+	if self.queued && len(self.running) == 0 && !self.stopped && !isExiting() {
+		manual := self.queuedManual
+		self.queued, self.queuedManual = false, false
+		self.start(manual)
+	}
+}
+
+func (self *Timer) failRun(run *timerRun, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	logger.Printf("WARN (_) [timer] %s %s", self.name, msg)
+	self.Lock()
+	run.State = TimerRunFailed
+	run.Error = msg
+	self.Unlock()
+}
+
+func (self *Timer) runCommand(run *timerRun) {
+	cmd, out, err := cmdFromConf(&self.cmdConf, requestParams(nil), nil)
+	if err != nil {
+		self.failRun(run, "create command failed: %s", err.Error())
+		return
+	}
+	if out != nil {
+		out.Close()
+	}
+	output := newOutputBuffer(maxLoggedOutput)
+	self.output.attach(cmd, output)
+	logger.Printf("INFO (_) [timer] command: %v", cmd.Args)
+	limits, err := startCmd(cmd, &self.cmdConf.Limits)
+	if err != nil {
+		self.failRun(run, "start command failed: %s", err.Error())
+		return
+	}
+	pid := cmd.Process.Pid
+	self.Lock()
+	run.Pid = pid
+	self.Unlock()
+	logger.Printf("INFO (_) [timer] %s started. pid: %d%s", self.name, pid, limitsSuffix(limits))
+	timeout := time.Duration(self.cmdConf.Timeout) * time.Second
+	deadline := time.AfterFunc(timeout, func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	})
+	err = self.output.wait(cmd)
+	releaseLimits(cmd)
+	timedOut := !deadline.Stop()
+	self.output.flush()
+	if timedOut {
+		logger.Printf("WARN (_) [timer] %s command execution timeout: %d", self.name, self.cmdConf.Timeout)
+	} else if err != nil {
+		logger.Printf("WARN (_) [timer] %s command execution failed: %s", self.name, err.Error())
+	}
+	self.Lock()
+	defer self.Unlock()
+	result := newCmdResult(cmd.ProcessState, 0)
+	run.ExitCode, run.Signal = result.ExitCode, result.Signal
+	switch {
+	case timedOut:
+		run.State = TimerRunTimeout
+	case result.Signal != 0:
+		run.State = TimerRunKilled
+	default:
+		run.State = TimerRunExited
+	}
+	data, start, _ := output.Since(0)
+	run.Output = string(data)
+	if start > 0 {
+		run.Output = "..." + run.Output
+	}
+}
+
+func (self *Timer) Status() timerStatus {
+	self.Lock()
+	defer self.Unlock()
+	ret := timerStatus{
+		Name:    self.name,
+		Cron:    self.conf.Cron,
+		Overlap: self.conf.Overlap,
+		Next:    self.next,
+		Running: len(self.running),
+		Queued:  self.queued,
+		Paused:  self.paused,
+		Runs:    self.nextRunId,
+	}
+	if ret.Cron == "" {
+		ret.Tick = self.conf.Tick
+	}
+	if n := len(self.history); n > 0 {
+		last := *self.history[n-1]
+		if last.State == TimerRunRunning {
+			last.Duration = time.Since(last.Start).Seconds()
+		}
+		ret.Last = &last
+	}
+	return ret
+}
+
+// History returns recent runs, the oldest first
+func (self *Timer) History() []timerRun {
+	self.Lock()
+	defer self.Unlock()
+	ret := make([]timerRun, len(self.history))
+	for i, run := range self.history {
+		ret[i] = *run
+		if run.State == TimerRunRunning {
+			ret[i].Duration = time.Since(run.Start).Seconds()
+		}
+	}
+	return ret
+}
+
+type TimerServer struct {
+	*Session
+}
+
+func NewTimerServer(sess *Session) Handler {
+	return TimerServer{
+		Session: sess,
+	}
+}
+
+// /timers, /timers/<name>/status|history|output|stderr, POST /timers/<name>/trigger|pause|resume
+func (self TimerServer) serve() {
+	method := self.req.Method
+	if self.group == "" {
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+		list := timers.list()
+		ret := make([]timerStatus, 0, len(list))
+		for _, timer := range list {
+			ret = append(ret, timer.Status())
+		}
+		self.JsonEnd(ret)
+		return
+	}
+	timer := timers.get(self.group)
+	if timer == nil {
+		self.ErrorEnd(http.StatusNotFound, "timer %s not found", self.group)
+		return
+	}
+	if self.tail != "" {
+		self.ErrorEnd(http.StatusNotFound, "bad timer path: %s", self.req.URL.Path)
+		return
+	}
+	switch self.item {
+	case "status", "history", "output", "stderr":
+		if method != "GET" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+	case "trigger", "pause", "resume":
+		if method != "POST" {
+			self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
+			return
+		}
+	default:
+		self.ErrorEnd(http.StatusNotFound, "bad timer path: %s", self.req.URL.Path)
+		return
+	}
+	switch self.item {
+	case "status":
+		self.JsonEnd(timer.Status())
+	case "history":
+		self.JsonEnd(timer.History())
+	case "output":
+		self.serveLastLines(timer.output.stdoutTail)
+	case "stderr":
+		self.serveLastLines(timer.output.stderrTail)
+	case "trigger":
+		timer.fire(true)
+		self.info("timer %s triggered by %s", self.group, self.username)
+		self.JsonEnd(timer.Status())
+	case "pause":
+		timer.Pause()
+		self.info("timer %s paused by %s", self.group, self.username)
+		self.JsonEnd(timer.Status())
+	case "resume":
+		timer.Resume()
+		self.info("timer %s resumed by %s", self.group, self.username)
+		self.JsonEnd(timer.Status())
+	}
+}
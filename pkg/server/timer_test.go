@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestTimer(t *testing.T, name string, timerConf *conf.Timer) *Timer {
+	if timerConf.Tick == 0 {
+		timerConf.Tick = 3600
+	}
+	if timerConf.Deadline == 0 {
+		timerConf.Deadline = 10
+	}
+	timerConf.Lang = "bash"
+	timer, err := NewTimer(name, timerConf)
+	if err != nil {
+		t.Fatalf("create timer failed: %s", err)
+	}
+	return timer
+}
+
+func waitTimerIdle(t *testing.T, timer *Timer) {
+	for i := 0; i < 500; i++ {
+		timer.Lock()
+		idle := len(timer.running) == 0 && !timer.queued
+		timer.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timer runs not finished")
+}
+
+func timerStates(timer *Timer) []string {
+	ret := []string{}
+	for _, run := range timer.History() {
+		ret = append(ret, run.State)
+	}
+	return ret
+}
+
+func TestNewTimerError(t *testing.T) {
+	if _, err := NewTimer("t", &conf.Timer{Tick: 1, Overlap: "bad"}); err == nil {
+		t.Error("bad overlap should fail")
+	}
+	if _, err := NewTimer("t", &conf.Timer{}); err == nil {
+		t.Error("timer without schedule should fail")
+	}
+}
+
+func TestTimerRun(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "echo hello; echo world >&2; exit 3"})
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+	history := timer.History()
+	if len(history) != 1 {
+		t.Fatalf("should have 1 run, got %d", len(history))
+	}
+	run := history[0]
+	// stdout and stderr are read from different pipes, so the order is not kept
+	if run.State != TimerRunExited || run.ExitCode != 3 || (run.Output != "hello\nworld\n" && run.Output != "world\nhello\n") || run.Pid == 0 {
+		t.Errorf("bad run: %+v", run)
+	}
+	timer = newTestTimer(t, "t", &conf.Timer{Code: "sleep 10", Deadline: 1})
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+	if run = timer.History()[0]; run.State != TimerRunTimeout {
+		t.Errorf("run should timeout: %+v", run)
+	}
+}
+
+func TestTimerHistory(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "true", History: 3})
+	for i := 0; i < 5; i++ {
+		timer.fire(false)
+		waitTimerIdle(t, timer)
+	}
+	history := timer.History()
+	if len(history) != 3 || history[0].Id != 3 || history[2].Id != 5 {
+		t.Errorf("history should keep the last 3 runs: %+v", history)
+	}
+	if status := timer.Status(); status.Runs != 5 || status.Last == nil || status.Last.Id != 5 {
+		t.Errorf("bad status: %+v", status)
+	}
+	timer = newTestTimer(t, "t", &conf.Timer{Code: "head -c 2000 /dev/zero | tr '\\0' a; echo end"})
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+	output := timer.History()[0].Output
+	if len(output) != maxLoggedOutput+3 || output[:3] != "..." || output[len(output)-4:] != "end\n" {
+		t.Errorf("output should be truncated: %q", output)
+	}
+}
+
+func TestTimerOverlap(t *testing.T) {
+	cases := []struct {
+		overlap string
+		fires   int
+		states  []string
+	}{
+		{"", 3, []string{TimerRunExited, TimerRunSkipped, TimerRunSkipped}},
+		{TimerOverlapSkip, 2, []string{TimerRunExited, TimerRunSkipped}},
+		// queued runs are merged
+		{TimerOverlapQueue, 3, []string{TimerRunExited, TimerRunExited}},
+		{TimerOverlapConcurrent, 3, []string{TimerRunExited, TimerRunExited, TimerRunExited}},
+		{TimerOverlapKill, 2, []string{TimerRunKilled, TimerRunExited}},
+	}
+	for _, c := range cases {
+		timer := newTestTimer(t, "t", &conf.Timer{Code: "sleep 0.5", Overlap: c.overlap})
+		timer.fire(false)
+		// wait for the process to start, so that it can be killed
+		for i := 0; i < 100 && timer.History()[0].Pid == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 1; i < c.fires; i++ {
+			timer.fire(true)
+		}
+		waitTimerIdle(t, timer)
+		if history := timer.History(); !history[len(history)-1].Manual {
+			t.Errorf("%q: the last run should be manual: %+v", c.overlap, history[len(history)-1])
+		}
+		states := timerStates(timer)
+		if len(states) != len(c.states) {
+			t.Errorf("%q: states should be %v, got %v", c.overlap, c.states, states)
+			continue
+		}
+		for i := range states {
+			if states[i] != c.states[i] {
+				t.Errorf("%q: states should be %v, got %v", c.overlap, c.states, states)
+				break
+			}
+		}
+	}
+}
+
+func TestTimerLockSkip(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "true", Lock: conf.Lock{Name: "timer_test_lock"}})
+	lock := GetConfLock(&timer.lockConf)
+	lock.TryWithOwner(LockOwner{Command: "test"}, func() {
+		timer.fire(false)
+		waitTimerIdle(t, timer)
+	})
+	if run := timer.History()[0]; run.State != TimerRunSkipped || run.Error == "" {
+		t.Errorf("run should be skipped: %+v", run)
+	}
+}
+
+func TestRandomJitter(t *testing.T) {
+	if randomJitter(0) != 0 {
+		t.Error("no jitter should be 0")
+	}
+	for i := 0; i < 100; i++ {
+		if d := randomJitter(time.Second); d < 0 || d >= time.Second {
+			t.Errorf("bad jitter: %s", d)
+		}
+	}
+}
+
+func TestServeTimers(t *testing.T) {
+	timer := newTestTimer(t, "serve_test", &conf.Timer{Code: "echo hello"})
+	timers.add(timer)
+	timer.fire(false)
+	waitTimerIdle(t, timer)
+
+	req := httptest.NewRequest("GET", "/timers/serve_test/history", nil)
+	resp := httptest.NewRecorder()
+	NewTimerServer(&Session{req: req, resp: resp, resource: "timers", group: "serve_test", item: "history"}).serve()
+	var history []timerRun
+	if err := json.Unmarshal(resp.Body.Bytes(), &history); err != nil {
+		t.Fatalf("bad history: %s %s", err, resp.Body.String())
+	}
+	if len(history) != 1 || history[0].Output != "hello\n" {
+		t.Errorf("bad history: %+v", history)
+	}
+
+	req = httptest.NewRequest("GET", "/timers/serve_test/status", nil)
+	resp = httptest.NewRecorder()
+	NewTimerServer(&Session{req: req, resp: resp, resource: "timers", group: "serve_test", item: "status"}).serve()
+	var status timerStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+		t.Fatalf("bad status: %s %s", err, resp.Body.String())
+	}
+	if status.Name != "serve_test" || status.Overlap != TimerOverlapSkip || status.Tick != 3600 || status.Runs != 1 {
+		t.Errorf("bad status: %+v", status)
+	}
+
+	req = httptest.NewRequest("GET", "/timers", nil)
+	resp = httptest.NewRecorder()
+	NewTimerServer(&Session{req: req, resp: resp, resource: "timers"}).serve()
+	var list []timerStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil || len(list) == 0 {
+		t.Errorf("bad timer list: %s", resp.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/timers/serve_test/trigger", nil)
+	resp = httptest.NewRecorder()
+	NewTimerServer(&Session{req: req, resp: resp, resource: "timers", group: "serve_test", item: "trigger"}).serve()
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("trigger should be POST only, got %d", resp.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/timers/nothing/status", nil)
+	resp = httptest.NewRecorder()
+	NewTimerServer(&Session{req: req, resp: resp, resource: "timers", group: "nothing", item: "status"}).serve()
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unknown timer should be 404, got %d", resp.Code)
+	}
+}
+
+func TestServeTimerControl(t *testing.T) {
+	timer := newTestTimer(t, "control_test", &conf.Timer{Code: "echo hello"})
+	timers.add(timer)
+	serve := func(action string) timerStatus {
+		req := httptest.NewRequest("POST", "/timers/control_test/"+action, nil)
+		resp := httptest.NewRecorder()
+		NewTimerServer(&Session{req: req, resp: resp, resource: "timers", group: "control_test", item: action}).serve()
+		var status timerStatus
+		if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+			t.Fatalf("bad status of %s: %s %s", action, err, resp.Body.String())
+		}
+		return status
+	}
+	if status := serve("pause"); !status.Paused || !timer.Paused() {
+		t.Errorf("timer should be paused: %+v", status)
+	}
+	// manual triggers works even if paused
+	if status := serve("trigger"); status.Last == nil || !status.Last.Manual {
+		t.Errorf("timer should be triggered: %+v", status)
+	}
+	waitTimerIdle(t, timer)
+	if history := timer.History(); len(history) != 1 || history[0].Output != "hello\n" {
+		t.Errorf("bad history: %+v", history)
+	}
+	if status := serve("resume"); status.Paused || timer.Paused() {
+		t.Errorf("timer should be resumed: %+v", status)
+	}
+}
+
+func TestPausedTimer(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "true"})
+	timer.schedule = func(now time.Time) time.Time {
+		return now.Add(10 * time.Millisecond)
+	}
+	timer.Pause()
+	done := make(chan struct{})
+	go func() {
+		timer.run()
+		close(done)
+	}()
+	defer func() {
+		timer.Stop(time.Second)
+		<-done
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := len(timer.History()); n != 0 {
+		t.Errorf("paused timer should not run, got %d runs", n)
+	}
+	timer.Resume()
+	time.Sleep(100 * time.Millisecond)
+	timer.Pause()
+	if n := len(timer.History()); n == 0 {
+		t.Errorf("resumed timer should run")
+	}
+}
+
+func TestTimerStop(t *testing.T) {
+	timer := newTestTimer(t, "t", &conf.Timer{Code: "sleep 10", Overlap: TimerOverlapQueue})
+	timer.schedule = func(now time.Time) time.Time {
+		return now.Add(time.Hour)
+	}
+	done := make(chan struct{})
+	go func() {
+		timer.run()
+		close(done)
+	}()
+	timer.fire(false)
+	for i := 0; i < 100 && timer.History()[0].Pid == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	timer.fire(false)
+	t0 := time.Now()
+	timer.Stop(time.Second)
+	if d := time.Since(t0); d > 500*time.Millisecond {
+		t.Errorf("run should be terminated at once, got %s", d)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("timer loop should end")
+	}
+	timer.fire(false)
+	if states := timerStates(timer); len(states) != 1 || states[0] != TimerRunKilled {
+		t.Errorf("run should be killed and no more runs: %v", states)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+const (
+	TLSClientAuthOptional = "optional"
+	TLSClientAuthRequire  = "require"
+)
+
+// tlsLoader keeps the tls config loaded from files, which can be loaded again on reload
+// and is used by new connections.
+type tlsLoader struct {
+	sync.RWMutex
+	config *tls.Config
+}
+
+func loadTLSConfig(tlsConf *conf.TLS) (*tls.Config, error) {
+	clientAuth := tls.NoClientCert
+	switch tlsConf.ClientAuth {
+	case "", TLSClientAuthOptional:
+		// clients can still be authorized by keys
+		clientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		if tlsConf.ClientCA == "" {
+			return nil, fmt.Errorf("tls client auth %s needs client ca", tlsConf.ClientAuth)
+		}
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown tls client auth: %s", tlsConf.ClientAuth)
+	}
+	cert, err := tls.LoadX509KeyPair(tlsConf.Cert, tlsConf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert failed: %s", err)
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if tlsConf.ClientCA == "" {
+		return ret, nil
+	}
+	pem, err := ioutil.ReadFile(tlsConf.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("load tls client ca failed: %s", err)
+	}
+	ret.ClientCAs = x509.NewCertPool()
+	if !ret.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", tlsConf.ClientCA)
+	}
+	ret.ClientAuth = clientAuth
+	return ret, nil
+}
+
+func (self *tlsLoader) load(tlsConf *conf.TLS) error {
+	config, err := loadTLSConfig(tlsConf)
+	if err != nil {
+		return err
+	}
+	self.Lock()
+	self.config = config
+	self.Unlock()
+	return nil
+}
+
+// serverConfig returns the tls config for http.Server, which uses the latest loaded config for each connection
+func (self *tlsLoader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			self.RLock()
+			defer self.RUnlock()
+			return self.config, nil
+		},
+	}
+}
+
+// certNames returns names a client certificate can be mapped to a user by: common name and SANs
+func certNames(cert *x509.Certificate) []string {
+	ret := make([]string, 0, 4)
+	if cert.Subject.CommonName != "" {
+		ret = append(ret, cert.Subject.CommonName)
+	}
+	ret = append(ret, cert.DNSNames...)
+	ret = append(ret, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		ret = append(ret, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		ret = append(ret, uri.String())
+	}
+	return ret
+}
+
+// certUser finds the user of the verified client certificate. Returns "" if there is no certificate.
+func (self *Session) certUser() (string, error) {
+	if self.req.TLS == nil || len(self.req.TLS.VerifiedChains) == 0 {
+		return "", nil
+	}
+	cert := self.req.TLS.VerifiedChains[0][0]
+	names := certNames(cert)
+	usernames := make([]string, 0, len(self.config.Users))
+	for username := range self.config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		for _, allowed := range self.config.Users[username].Certs {
+			for _, name := range names {
+				if name == allowed {
+					return username, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no user for client certificate %s", cert.Subject.String())
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/xiezhenye/servant/pkg/conf"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func newTestCA(t *testing.T) *testCert {
+	return newTestCert(t, 1, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "servant test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestServerCert(t *testing.T, serial int64, ca *testCert) *testCert {
+	return newTestCert(t, serial, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "servant"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+}
+
+func newTestClientCert(t *testing.T, serial int64, name string, ca *testCert) *testCert {
+	return newTestCert(t, serial, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+}
+
+// save writes the cert and the key as PEM files in dir
+func (self *testCert) save(t *testing.T, dir, name string) (certPath, keyPath string) {
+	certPath, keyPath = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: self.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (self *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{self.cert.Raw}, PrivateKey: self.key, Leaf: self.cert}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	caPath, _ := ca.save(t, dir, "ca")
+	certPath, keyPath := newTestServerCert(t, 2, ca).save(t, dir, "server")
+
+	if _, err := loadTLSConfig(&conf.TLS{Cert: filepath.Join(dir, "none.crt"), Key: keyPath}); err == nil {
+		t.Errorf("missing cert should fail")
+	}
+	if _, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: caPath}); err == nil {
+		t.Errorf("mismatched key should fail")
+	}
+	if _, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientCA: keyPath}); err == nil {
+		t.Errorf("client ca without certificates should fail")
+	}
+	if _, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: "x"}); err == nil {
+		t.Errorf("unknown client auth should fail")
+	}
+	if _, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientAuth: "requier"}); err == nil {
+		t.Errorf("unknown client auth without client ca should fail")
+	}
+	if _, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientAuth: TLSClientAuthRequire}); err == nil {
+		t.Errorf("required client auth without client ca should fail")
+	}
+	config, err := loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath})
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("tls config wrong: %v %v", config.ClientAuth, config.MinVersion)
+	}
+	config, err = loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientCA: caPath})
+	if err != nil || config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("optional client auth wrong: %v", err)
+	}
+	config, err = loadTLSConfig(&conf.TLS{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: TLSClientAuthRequire})
+	if err != nil || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("required client auth wrong: %v", err)
+	}
+}
+
+func TestTLSServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servant-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	caPath, _ := ca.save(t, dir, "ca")
+	certPath, keyPath := newTestServerCert(t, 2, ca).save(t, dir, "server")
+	tlsConf := &conf.TLS{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: TLSClientAuthRequire}
+	loader := &tlsLoader{}
+	if err := loader.load(tlsConf); err != nil {
+		t.Fatal(err)
+	}
+	config := &conf.Config{Users: map[string]*conf.User{
+		"u1": {Certs: []string{"client1"}},
+	}}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := &Session{config: config, req: r, resp: w}
+		username, err := sess.certUser()
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		w.Write([]byte(username))
+	}))
+	ts.TLS = loader.serverConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCert *testCert) (string, *big.Int, error) {
+		clientConf := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			clientConf.Certificates = []tls.Certificate{clientCert.tlsCert()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].SerialNumber, nil
+	}
+	username, serial, err := get(newTestClientCert(t, 3, "client1", ca))
+	if err != nil || username != "u1" || serial.Int64() != 2 {
+		t.Errorf("client cert should be of u1: %q %v %v", username, serial, err)
+	}
+	if _, _, err := get(nil); err == nil {
+		t.Errorf("client cert is required")
+	}
+	// certificates are loaded again for new connections
+	newCertPath, newKeyPath := newTestServerCert(t, 4, ca).save(t, dir, "server")
+	if newCertPath != certPath || newKeyPath != keyPath {
+		t.Fatal("cert path changed")
+	}
+	if err := loader.load(tlsConf); err != nil {
+		t.Fatal(err)
+	}
+	username, serial, err = get(newTestClientCert(t, 5, "client1", ca))
+	if err != nil || username != "u1" || serial.Int64() != 4 {
+		t.Errorf("new server cert should be used: %q %v %v", username, serial, err)
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	config := &conf.Config{
+		Auth: conf.Auth{Enabled: true, MaxTimeDelta: 300},
+		Users: map[string]*conf.User{
+			"u1": {Key: "k1", Certs: []string{"client1"}},
+			"u2": {Key: "k2", Certs: []string{"client2"}, Hosts: []string{"10.0.0.0/8"}},
+		},
+	}
+	newSession := func(cert *testCert) *Session {
+		req := httptest.NewRequest("GET", "/commands/db1/foo", nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.cert, ca.cert}}}
+		}
+		return &Session{config: config, req: req}
+	}
+	if username, err := newSession(newTestClientCert(t, 2, "client1", ca)).auth(); err != nil || username != "u1" {
+		t.Errorf("client1 should be u1: %s %v", username, err)
+	}
+	if _, err := newSession(newTestClientCert(t, 3, "client2", ca)).auth(); err == nil {
+		t.Errorf("hosts of u2 should be checked")
+	}
+	if _, err := newSession(newTestClientCert(t, 4, "client3", ca)).auth(); err == nil {
+		t.Errorf("cert of no user should be denied")
+	}
+	sess := newSession(newTestClientCert(t, 5, "client1", ca))
+	signRequest(sess.req, "u2", "k2", time.Now().Unix(), nil, nil)
+	if _, err := sess.auth(); err == nil {
+		t.Errorf("user not matching cert should be denied")
+	}
+	if _, err := newSession(nil).auth(); err == nil {
+		t.Errorf("no cert and no header should be denied")
+	}
+}